@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/picker"
+)
+
+// checkResult is a result of a single node probe
+type checkResult struct {
+	svc     string
+	pos     int
+	node    config.Node
+	latency time.Duration
+	err     error
+}
+
+// runCheck loads and validates config, probes every node once and prints results table to out.
+// Returns exit code, non-zero if config is invalid or any service has no healthy node.
+func runCheck(confFile string, timeout time.Duration, out io.Writer) int {
+	fh, err := os.Open(confFile) // nolint:gosec // config file name comes from cli
+	if err != nil {
+		fmt.Fprintf(out, "failed to open %s, %v\n", confFile, err)
+		return 1
+	}
+	conf, warnings, err := config.Load(fh)
+	_ = fh.Close()
+	for _, w := range warnings {
+		fmt.Fprintf(out, "warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "failed to load %s, %v\n", confFile, err)
+		return 1
+	}
+
+	results := probeNodes(conf.Get(), timeout)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tNODE\tMETHOD\tSTATUS\tLATENCY\tERROR")
+	healthy := map[string]int{}
+	for _, r := range results {
+		status, errMsg := "ok", ""
+		if r.err != nil {
+			status, errMsg = "failed", r.err.Error()
+		}
+		if r.err == nil && r.node.Weight > 0 {
+			healthy[r.svc]++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%s\n", r.svc, r.node.Server+r.node.Ping, r.node.Method, status,
+			r.latency.Round(time.Millisecond), errMsg)
+	}
+	_ = tw.Flush()
+
+	code := 0
+	for _, svc := range sortedServices(conf.Get()) {
+		if healthy[svc] == 0 {
+			fmt.Fprintf(out, "service %s has no healthy node\n", svc)
+			code = 1
+		}
+	}
+	return code
+}
+
+// probeNodes checks all nodes in parallel with node's timeout, timeout used if not defined.
+// Results sorted by service and node position.
+func probeNodes(services config.ServicesMap, timeout time.Duration) []checkResult {
+	var results []checkResult
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for name, svc := range services {
+		for i, n := range svc.Nodes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st := time.Now()
+				nodeTimeout := timeout
+				if n.Timeout > 0 {
+					nodeTimeout = n.Timeout
+				}
+				err := picker.Check(context.Background(), n, nodeTimeout)
+				lock.Lock()
+				results = append(results, checkResult{svc: name, pos: i, node: n, latency: time.Since(st), err: err})
+				lock.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].svc != results[j].svc {
+			return results[i].svc < results[j].svc
+		}
+		return results[i].pos < results[j].pos
+	})
+	return results
+}
+
+func sortedServices(services config.ServicesMap) []string {
+	res := make([]string, 0, len(services))
+	for svc := range services {
+		res = append(res, svc)
+	}
+	sort.Strings(res)
+	return res
+}
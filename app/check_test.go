@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	writeConf := func(body string) string {
+		fname := filepath.Join(t.TempDir(), "rlb.yml")
+		require.NoError(t, os.WriteFile(fname, []byte(body), 0o600))
+		return fname
+	}
+
+	t.Run("all services healthy", func(t *testing.T) {
+		ts2URL := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+		conf := fmt.Sprintf("services:\n svc1:\n  - server: %s\n    ping: /ping\n    weight: 1\n"+
+			"  - server: %s\n    ping: /bad\n    method: GET\n    weight: 1\n", ts.URL, ts2URL)
+		out := bytes.Buffer{}
+		code := runCheck(writeConf(conf), time.Second, &out)
+		t.Log(out.String())
+		assert.Equal(t, 0, code)
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, lines, 3)
+		assert.Regexp(t, `^SERVICE\s+NODE\s+METHOD\s+STATUS\s+LATENCY\s+ERROR$`, lines[0])
+		assert.Regexp(t, `^svc1\s+`+ts.URL+`/ping\s+HEAD\s+ok\s+\S+\s*$`, lines[1])
+		assert.Regexp(t, `^svc1\s+`+ts2URL+`/bad\s+GET\s+failed\s+\S+\s+bad status code 404`, lines[2])
+	})
+
+	t.Run("service without healthy node", func(t *testing.T) {
+		conf := fmt.Sprintf("services:\n svc1:\n  - server: %s\n    ping: /ping\n    weight: 1\n"+
+			" svc2:\n  - server: %s\n    ping: /bad\n    weight: 1\n"+
+			" svc3:\n  - server: %s\n    ping: /ping\n    weight: 0\n", ts.URL, ts.URL, ts.URL)
+		out := bytes.Buffer{}
+		code := runCheck(writeConf(conf), time.Second, &out)
+		t.Log(out.String())
+		assert.Equal(t, 1, code)
+		assert.Contains(t, out.String(), "warning: service svc3, weight: all weights are 0, service never served")
+		assert.NotContains(t, out.String(), "service svc1 has no healthy node")
+		assert.Contains(t, out.String(), "service svc2 has no healthy node")
+		assert.Contains(t, out.String(), "service svc3 has no healthy node")
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		out := bytes.Buffer{}
+		code := runCheck(writeConf("services:\n svc1:\n  - server: blah\n    weight: -1\n"), time.Second, &out)
+		assert.Equal(t, 1, code)
+		assert.Contains(t, out.String(), "service svc1, node #1, weight: negative weight -1")
+		assert.NotContains(t, out.String(), "SERVICE")
+	})
+
+	t.Run("missing config", func(t *testing.T) {
+		out := bytes.Buffer{}
+		code := runCheck("/no-such-dir/rlb.yml", time.Second, &out)
+		assert.Equal(t, 1, code)
+		assert.Contains(t, out.String(), "failed to open /no-such-dir/rlb.yml")
+	})
+}
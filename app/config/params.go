@@ -5,21 +5,135 @@ package config
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	log "github.com/go-pkgz/lgr"
 	"gopkg.in/yaml.v3"
 )
 
-// NodesMap wraps map with svc name as a key and all svc nodes as value
-type NodesMap map[string][]Node
+// supported node selection strategies
+const (
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round-robin"
+	StrategyHash       = "hash"
+)
+
+// non-http check methods
+const (
+	MethodTCP = "tcp" // only connects to node's host and port
+	MethodDNS = "dns" // only resolves node's host
+)
+
+// supported stats sinks
+const (
+	SinkHTTP   = "http"   // POST batches of records as JSON array, or one record per request
+	SinkFile   = "file"   // append records to rotating NDJSON file
+	SinkSyslog = "syslog" // send records to syslog, one JSON per message
+	SinkStore  = "store"  // aggregate records in embedded stats store, served by stats API
+)
+
+// request formats of http stats sink
+const (
+	FormatBatch  = "batch"  // JSON array of records per request
+	FormatSingle = "single" // one JSON record per request, like legacy --stats url
+)
+
+// responses to requests with referer not allowed
+const (
+	RefererForbidden = "forbidden" // 403
+	RefererRedirect  = "redirect"  // redirect to landing page
+	RefererMessage   = "message"   // 403 with html message, like no_node one
+)
+
+// ServicesMap wraps map with svc name as a key and svc definition as value
+type ServicesMap map[string]Service
+
+// Service has nodes and the strategy to pick one of them.
+// Can be defined as a plain list of nodes or as a map with strategy and nodes keys.
+type Service struct {
+	Strategy string `yaml:"strategy"`
+	Rise     int    `yaml:"rise"` // default rise for all nodes of the service
+	Fall     int    `yaml:"fall"` // default fall for all nodes of the service
+	Nodes    []Node `yaml:"nodes"`
+
+	Interval time.Duration `yaml:"interval"` // default check interval for all nodes of the service
+	Timeout  time.Duration `yaml:"timeout"`  // default check timeout for all nodes of the service
+	Jitter   time.Duration `yaml:"jitter"`   // default check jitter for all nodes of the service
+
+	Passive PassiveCheck  `yaml:"passive"`
+	Breaker BreakerParams `yaml:"breaker"`
+
+	RedirectCode int           `yaml:"redirect_code"` // redirect status code, 302 if not defined
+	CacheMaxAge  time.Duration `yaml:"cache_max_age"` // max-age of cacheable redirect, not cached if not defined
+
+	AllowedPaths []string `yaml:"allowed_paths"` // regexes of allowed resource paths, any path allowed if empty
+
+	Sign SignParams `yaml:"sign"`
+
+	AllowedReferers   []string      `yaml:"allowed_referers"`    // referer hosts or *.domain patterns, any referer allowed if empty
+	AllowEmptyReferer bool          `yaml:"allow_empty_referer"` // allow requests without referer, checked only with allowed referers
+	RefererDenied     RefererAction `yaml:"referer_denied"`      // response to requests with referer not allowed
+}
+
+// RefererAction defines response to requests with referer not allowed
+type RefererAction struct {
+	Action  string `yaml:"action"`  // forbidden (default), redirect or message
+	URL     string `yaml:"url"`     // landing page for redirect
+	Message string `yaml:"message"` // html body for message
+}
+
+// SignParams defines signed links of the service and tokens for nodes
+type SignParams struct {
+	Secret     string        `yaml:"secret"`      // HMAC secret, only signed links allowed if defined
+	NodeSecret string        `yaml:"node_secret"` // nginx secure_link secret, redirect url gets md5 token if defined
+	NodeTTL    time.Duration `yaml:"node_ttl"`    // node token lifetime if link not signed, 1h by default
+}
+
+// PassiveCheck defines ejection of nodes failed failback HEAD probes of real requests
+type PassiveCheck struct {
+	Fails    int           `yaml:"fails"`    // consecutive failed probes to eject the node, 0 disables
+	Cooldown time.Duration `yaml:"cooldown"` // ejected node stays dead at least this long
+}
+
+// BreakerParams defines per-node circuit breaker driven by failback HEAD probes of real requests
+type BreakerParams struct {
+	FailureRatio   float64       `yaml:"failure_ratio"`    // ratio of failed probes to open the breaker, 0 disables
+	MinRequests    int           `yaml:"min_requests"`     // min probes in the window to consider the ratio
+	Window         time.Duration `yaml:"window"`           // time window to count the ratio in
+	OpenDuration   time.Duration `yaml:"open_duration"`    // time the open breaker keeps node out of rotation
+	HalfOpenTrials int           `yaml:"half_open_trials"` // trial requests of half-open breaker, all successful close it
+}
 
 // ConfFile map by svc for node:conf
 type ConfFile struct {
-	Services NodesMap `yaml:"services"`
+	Services ServicesMap `yaml:"services"`
 	NoNode   struct {
 		Message string `yaml:"message"`
 	} `yaml:"no_node"`
-	FailBackURL string `yaml:"failback"`
+	FailBackURL string            `yaml:"failback"`
+	Stats       []StatsSinkParams `yaml:"stats"`
+	Hosts       map[string]string `yaml:"hosts"` // host or wildcard host pattern like *.example.com to service
+}
+
+// StatsSinkParams defines a sink for stats records, all sinks get every record
+type StatsSinkParams struct {
+	Type string `yaml:"type"` // http, file, syslog or store
+
+	URL    string `yaml:"url"`    // http
+	Format string `yaml:"format"` // http request format, batch by default or single
+
+	Path       string `yaml:"path"`        // file, or store file to persist counters
+	MaxSize    int    `yaml:"max_size"`    // file size in MB to rotate, 0 disables rotation
+	MaxBackups int    `yaml:"max_backups"` // rotated files to keep
+
+	Bucket    time.Duration `yaml:"bucket"`    // store time bucket, 1h by default
+	Retention time.Duration `yaml:"retention"` // store max age of buckets, 30 days by default
+
+	Network string `yaml:"network"` // syslog, udp, tcp, unix or unixgram, local syslog if empty
+	Address string `yaml:"address"` // syslog host:port or socket path
+	Tag     string `yaml:"tag"`     // syslog tag, rlb if empty
 }
 
 // Node has a part from config and alive + changed for status monitoring
@@ -28,37 +142,183 @@ type Node struct {
 	Ping   string `yaml:"ping"`
 	Weight int    `yaml:"weight"`
 	Method string `yaml:"method"`
+	Rise   int    `yaml:"rise"` // consecutive successful checks to mark dead node alive
+	Fall   int    `yaml:"fall"` // consecutive failed checks to mark alive node dead
+
+	Interval time.Duration `yaml:"interval"` // check interval, global refresh if not defined
+	Timeout  time.Duration `yaml:"timeout"`  // check timeout, global timeout if not defined
+	Jitter   time.Duration `yaml:"jitter"`   // max random delay added to the interval to spread checks
+
+	ExpectStatus       StatusList        `yaml:"expect_status"`        // healthy status codes, any below 400 if empty
+	ExpectBody         string            `yaml:"expect_body"`          // substring expected in the response body, GET only
+	ExpectBodyRe       string            `yaml:"expect_body_re"`       // regex expected to match the response body, GET only
+	Headers            map[string]string `yaml:"headers"`              // custom check request headers, including Host
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"` // skip TLS certificate verification
+	CAFile             string            `yaml:"ca_file"`              // custom CA to verify node's TLS certificate
+}
+
+// StatusRange is an inclusive range of http status codes
+type StatusRange struct {
+	From, To int
+}
+
+// StatusList is a list of status codes, defined as a single code, a range like "200-299" or a list of codes and ranges
+type StatusList []StatusRange
+
+// Load makes new config for yml reader and validates it.
+// Returns *ValidationError listing all problems if config is invalid and warnings for suspicious but usable config.
+func Load(reader io.Reader) (conf *ConfFile, warnings []Issue, err error) {
+	if conf, err = parse(reader); err != nil {
+		return nil, nil, err
+	}
+	if warnings, err = conf.Validate(); err != nil {
+		return nil, warnings, err
+	}
+	return conf, warnings, nil
 }
 
-// NewConf makes new config for yml reader
-func NewConf(reader io.Reader) *ConfFile {
+// parse reads and unmarshals yml config
+func parse(reader io.Reader) (*ConfFile, error) {
 	res := &ConfFile{}
 	data, err := io.ReadAll(reader)
 	if err != nil {
-		log.Fatalf("[ERROR] failed to read config, %v", err)
+		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 	if err = yaml.Unmarshal(data, &res); err != nil {
-		log.Fatalf("[ERROR] failed to parse config, %v", err)
+		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
-	return res
+	return res, nil
 }
 
-// Get map svc:[nodes] and set default method to HEAD (if not defined)
-func (c ConfFile) Get() NodesMap {
-	res := make(map[string][]Node)
-	for service, nodeConf := range c.Services {
-		res[service] = []Node{}
-		for _, n := range nodeConf {
+// Get map svc:service, set default method to HEAD and strategy to random (if not defined).
+// Node's rise and fall inherited from service if not defined, 1 by default.
+// Node's interval, timeout and jitter inherited from service if not defined.
+// Enabled breaker gets defaults for params not defined. Redirect code is 302 if not defined.
+// Node token lifetime is 1h if not defined.
+func (c ConfFile) Get() ServicesMap {
+	res := make(ServicesMap)
+	for name, svc := range c.Services {
+		if svc.Strategy == "" {
+			svc.Strategy = StrategyRandom
+		}
+		nodes := make([]Node, 0, len(svc.Nodes))
+		for _, n := range svc.Nodes {
 			if n.Method == "" {
 				n.Method = "HEAD"
 			}
-			res[service] = append(res[service], n)
+			n.Rise = firstPositive(n.Rise, svc.Rise, 1)
+			n.Fall = firstPositive(n.Fall, svc.Fall, 1)
+			n.Interval = firstPositiveDuration(n.Interval, svc.Interval)
+			n.Timeout = firstPositiveDuration(n.Timeout, svc.Timeout)
+			n.Jitter = firstPositiveDuration(n.Jitter, svc.Jitter)
+			nodes = append(nodes, n)
 		}
-
+		svc.Nodes = nodes
+		if svc.RedirectCode == 0 {
+			svc.RedirectCode = http.StatusFound
+		}
+		if svc.Sign.NodeSecret != "" && svc.Sign.NodeTTL <= 0 {
+			svc.Sign.NodeTTL = time.Hour
+		}
+		if svc.Breaker.FailureRatio > 0 {
+			svc.Breaker.MinRequests = firstPositive(svc.Breaker.MinRequests, 5)
+			svc.Breaker.HalfOpenTrials = firstPositive(svc.Breaker.HalfOpenTrials, 1)
+			if svc.Breaker.Window <= 0 {
+				svc.Breaker.Window = time.Minute
+			}
+			if svc.Breaker.OpenDuration <= 0 {
+				svc.Breaker.OpenDuration = 30 * time.Second
+			}
+		}
+		res[name] = svc
 	}
 	return res
 }
 
+// UnmarshalYAML supports legacy format with a plain list of nodes as well as the map with strategy and nodes
+func (s *Service) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&s.Nodes)
+	}
+	type plain Service // prevents recursion
+	return value.Decode((*plain)(s))
+}
+
 func (n Node) String() string {
-	return fmt.Sprintf("{server:%s, ping:%s, weight:%d, method:%s}", n.Server, n.Ping, n.Weight, n.Method)
+	return fmt.Sprintf("{server:%s, ping:%s, weight:%d, method:%s, rise:%d, fall:%d, interval:%v, timeout:%v, jitter:%v}",
+		n.Server, n.Ping, n.Weight, n.Method, n.Rise, n.Fall, n.Interval, n.Timeout, n.Jitter)
+}
+
+// Match checks if code is in the list. Empty list matches any code below 400
+func (l StatusList) Match(code int) bool {
+	if len(l) == 0 {
+		return code < 400
+	}
+	for _, r := range l {
+		if code >= r.From && code <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (l StatusList) String() string {
+	res := make([]string, 0, len(l))
+	for _, r := range l {
+		if r.From == r.To {
+			res = append(res, strconv.Itoa(r.From))
+			continue
+		}
+		res = append(res, fmt.Sprintf("%d-%d", r.From, r.To))
+	}
+	return strings.Join(res, ",")
+}
+
+// UnmarshalYAML parses a single code or range as well as the list of them
+func (l *StatusList) UnmarshalYAML(value *yaml.Node) error {
+	var items []string
+	if value.Kind == yaml.SequenceNode {
+		if err := value.Decode(&items); err != nil {
+			return err
+		}
+	} else {
+		items = []string{value.Value}
+	}
+
+	res := make(StatusList, 0, len(items))
+	for _, item := range items {
+		from, to, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			to = from
+		}
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return fmt.Errorf("invalid status %q: %w", item, err)
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return fmt.Errorf("invalid status %q: %w", item, err)
+		}
+		res = append(res, StatusRange{From: f, To: t})
+	}
+	*l = res
+	return nil
+}
+
+func firstPositive(vals ...int) int {
+	for _, v := range vals {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func firstPositiveDuration(vals ...time.Duration) time.Duration {
+	for _, v := range vals {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
 }
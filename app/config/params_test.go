@@ -1,25 +1,378 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestGet(t *testing.T) {
-	conf := NewConf(strings.NewReader(rlbYaml))
+	conf, warnings, err := Load(strings.NewReader(rlbYaml))
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
 	r := conf.Get()
 	assert.Equal(t, 2, len(r), "2 services in the map")
-	assert.Equal(t, 3, len(r["test1"]), "3 nodes in test1")
+	assert.Equal(t, 3, len(r["test1"].Nodes), "3 nodes in test1")
 
-	assert.Equal(t, "HEAD", r["test1"][0].Method, "HEAD as a default method")
-	assert.Equal(t, "HEAD", r["test1"][1].Method, "HEAD as explicit method")
-	assert.Equal(t, "GET", r["test1"][2].Method, "GET as explicit method")
+	assert.Equal(t, "HEAD", r["test1"].Nodes[0].Method, "HEAD as a default method")
+	assert.Equal(t, "HEAD", r["test1"].Nodes[1].Method, "HEAD as explicit method")
+	assert.Equal(t, "GET", r["test1"].Nodes[2].Method, "GET as explicit method")
+	assert.Equal(t, "random", r["test1"].Strategy, "random as a default strategy")
+	assert.Equal(t, "hash", r["test2"].Strategy)
+	assert.Equal(t, 2, len(r["test2"].Nodes), "2 nodes in test2")
+
+	assert.Equal(t, 1, r["test1"].Nodes[0].Rise, "default rise")
+	assert.Equal(t, 1, r["test1"].Nodes[0].Fall, "default fall")
+	assert.Equal(t, 2, r["test2"].Nodes[0].Rise, "rise from service")
+	assert.Equal(t, 3, r["test2"].Nodes[0].Fall, "fall from service")
+	assert.Equal(t, 5, r["test2"].Nodes[1].Rise, "rise from node")
+	assert.Equal(t, 3, r["test2"].Nodes[1].Fall, "fall from service")
+
+	assert.Equal(t, time.Duration(0), r["test1"].Nodes[0].Interval, "no interval, global refresh used")
+	assert.Equal(t, 10*time.Second, r["test2"].Nodes[0].Interval, "interval from service")
+	assert.Equal(t, 2*time.Second, r["test2"].Nodes[0].Timeout, "timeout from service")
+	assert.Equal(t, time.Duration(0), r["test2"].Nodes[0].Jitter)
+	assert.Equal(t, 10*time.Second, r["test2"].Nodes[1].Interval, "interval from service")
+	assert.Equal(t, 15*time.Second, r["test2"].Nodes[1].Timeout, "timeout from node")
+	assert.Equal(t, time.Second, r["test2"].Nodes[1].Jitter, "jitter from node")
+
+	assert.Equal(t, 302, r["test1"].RedirectCode, "default redirect code")
+	assert.Equal(t, time.Duration(0), r["test1"].CacheMaxAge)
+	assert.Equal(t, 307, r["test2"].RedirectCode)
+	assert.Equal(t, time.Hour, r["test2"].CacheMaxAge)
+
+	assert.Equal(t, PassiveCheck{}, r["test1"].Passive)
+	assert.Equal(t, PassiveCheck{Fails: 3, Cooldown: 30 * time.Second}, r["test2"].Passive)
+
+	assert.Equal(t, BreakerParams{}, r["test1"].Breaker, "disabled breaker")
+	assert.Equal(t, BreakerParams{FailureRatio: 0.5, MinRequests: 5, Window: time.Minute,
+		OpenDuration: 10 * time.Second, HalfOpenTrials: 1}, r["test2"].Breaker, "defaults for enabled breaker")
 	assert.Equal(t, "blah", conf.NoNode.Message)
 	assert.Equal(t, "http://archive.radio-t.com/media", conf.FailBackURL)
 }
 
+func TestLoad_Errors(t *testing.T) {
+	_, _, err := Load(strings.NewReader("services: [blah\n bad"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse config")
+
+	_, _, err = Load(strings.NewReader("no_node:\n message: blah\n"))
+	require.Error(t, err)
+	assert.Equal(t, "invalid config, 1 error(s): services: no services defined", err.Error())
+}
+
+func TestValidate(t *testing.T) {
+	conf := ConfFile{
+		FailBackURL: "archive.radio-t.com",
+		Services: ServicesMap{
+			"empty": {},
+			"bad": {Strategy: "blah", Nodes: []Node{
+				{Server: "", Weight: 1},
+				{Server: "n2.radio-t.com", Weight: 1},
+				{Server: "http://n3.radio-t.com", Ping: "ping", Weight: -1, Method: "POST", Fall: -1},
+				{Server: "http://n4.radio-t.com", Ping: "/ping", Weight: 1, Method: "GET"},
+			}},
+			"warn": {Strategy: "round-robin", Nodes: []Node{
+				{Server: "http://n1.radio-t.com", Ping: "/ping", Weight: 0},
+				{Server: "http://n1.radio-t.com", Ping: "/ping", Weight: 0},
+			}},
+		},
+	}
+
+	warnings, err := conf.Validate()
+	require.Error(t, err)
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Field: "failback", Message: `invalid url "archive.radio-t.com", should be http(s)://host[:port][/path]`},
+		{Service: "bad", Field: "strategy", Message: `unsupported strategy "blah", allowed random, round-robin or hash`},
+		{Service: "bad", Node: 1, Field: "server", Message: "empty server"},
+		{Service: "bad", Node: 2, Field: "server", Message: `invalid url "n2.radio-t.com", should be http(s)://host[:port][/path]`},
+		{Service: "bad", Node: 3, Field: "ping", Message: `ping "ping" should start with /`},
+		{Service: "bad", Node: 3, Field: "weight", Message: "negative weight -1"},
+		{Service: "bad", Node: 3, Field: "fall", Message: "negative fall -1"},
+		{Service: "bad", Node: 3, Field: "method", Message: `unsupported method "POST", allowed HEAD, GET, tcp or dns`},
+		{Service: "empty", Message: "no nodes defined"},
+	}, verr.Issues)
+	assert.Contains(t, err.Error(), "invalid config, 9 error(s): failback: invalid url")
+	assert.Contains(t, err.Error(), "; service bad, node #3, weight: negative weight -1;")
+
+	assert.Equal(t, []Issue{
+		{Service: "warn", Node: 2, Field: "server", Message: "duplicate server http://n1.radio-t.com, same as node #1"},
+		{Service: "warn", Field: "weight", Message: "all weights are 0, service never served"},
+	}, warnings)
+	assert.Equal(t, "service warn, weight: all weights are 0, service never served", warnings[1].String())
+}
+
+func TestValidate_Passive(t *testing.T) {
+	conf := ConfFile{Services: ServicesMap{
+		"bad": {Passive: PassiveCheck{Fails: -1, Cooldown: -time.Second},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+		"no-failback": {Passive: PassiveCheck{Fails: 2, Cooldown: time.Second},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+	}}
+
+	warnings, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "passive.fails", Message: "negative fails -1"},
+		{Service: "bad", Field: "passive.cooldown", Message: "negative cooldown -1s"},
+	}, verr.Issues)
+	assert.Equal(t, []Issue{{Service: "no-failback", Field: "passive",
+		Message: "passive checks need failback probes, ignored without failback"}}, warnings)
+
+	conf.FailBackURL = "http://archive.radio-t.com"
+	delete(conf.Services, "bad")
+	warnings, err = conf.Validate()
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidate_Schedule(t *testing.T) {
+	conf := ConfFile{Services: ServicesMap{
+		"bad": {Interval: -time.Second, Nodes: []Node{
+			{Server: "http://n1.radio-t.com", Weight: 1, Timeout: -time.Second},
+			{Server: "http://n2.radio-t.com", Weight: 1, Interval: 5 * time.Second, Jitter: time.Second},
+		}},
+	}}
+
+	_, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "interval", Message: "negative interval -1s, timeout 0s or jitter 0s"},
+		{Service: "bad", Node: 1, Field: "interval", Message: "negative interval 0s, timeout -1s or jitter 0s"},
+	}, verr.Issues)
+}
+
+func TestValidate_Redirect(t *testing.T) {
+	conf := ConfFile{Services: ServicesMap{
+		"good": {RedirectCode: 308, CacheMaxAge: time.Hour, Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+		"bad": {RedirectCode: 200, CacheMaxAge: -time.Second, AllowedPaths: []string{`^/rtfiles/.*\.mp3$`, "[bad"},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+	}}
+
+	_, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "redirect_code", Message: "unsupported redirect code 200, allowed 301, 302, 303, 307 or 308"},
+		{Service: "bad", Field: "cache_max_age", Message: "negative cache max-age -1s"},
+		{Service: "bad", Field: "allowed_paths", Message: "error parsing regexp: missing closing ]: `[bad`"},
+	}, verr.Issues)
+}
+
+func TestValidate_Hosts(t *testing.T) {
+	conf := ConfFile{
+		Services: ServicesMap{"podcast": {Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}}},
+		Hosts: map[string]string{
+			"media.example.com":      "podcast",
+			"*.cdn.example.com":      "podcast",
+			"Media.Example.com":      "podcast",
+			"stream.example.com":     "radio",
+			"bad*.example.com":       "podcast",
+			"media.example.com:8080": "podcast",
+		},
+	}
+
+	_, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Field: "hosts bad*.example.com", Message: "invalid host, should be a host name or *.domain pattern"},
+		{Field: "hosts media.example.com", Message: "duplicate host"},
+		{Field: "hosts media.example.com:8080", Message: "invalid host, should be a host name or *.domain pattern"},
+		{Field: "hosts stream.example.com", Message: `unknown service "radio"`},
+	}, verr.Issues)
+}
+
+func TestValidate_Sign(t *testing.T) {
+	conf := ConfFile{Services: ServicesMap{
+		"good": {Sign: SignParams{Secret: "0123456789abcdef", NodeSecret: "0123456789abcdef"},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+		"weak": {Sign: SignParams{Secret: "secret"}, Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+	}}
+	warnings, err := conf.Validate()
+	require.NoError(t, err)
+	assert.Equal(t, []Issue{{Service: "weak", Field: "sign", Message: "secret shorter than 16 chars is easy to guess"}}, warnings)
+	assert.Equal(t, time.Hour, conf.Get()["good"].Sign.NodeTTL, "default node ttl")
+	assert.Equal(t, time.Duration(0), conf.Get()["weak"].Sign.NodeTTL, "no node secret, no ttl")
+
+	conf.Services["bad"] = Service{Sign: SignParams{NodeSecret: "0123456789abcdef", NodeTTL: -time.Second},
+		Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}}
+	_, err = conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{{Service: "bad", Field: "sign.node_ttl", Message: "negative node ttl -1s"}}, verr.Issues)
+}
+
+func TestValidate_Referers(t *testing.T) {
+	nodes := []Node{{Server: "http://n1.radio-t.com", Weight: 1}}
+	conf := ConfFile{Services: ServicesMap{
+		"forbidden": {AllowedReferers: []string{"radio-t.com", "*.Radio-T.com"}, AllowEmptyReferer: true, Nodes: nodes},
+		"redirect": {AllowedReferers: []string{"radio-t.com"}, Nodes: nodes,
+			RefererDenied: RefererAction{Action: RefererRedirect, URL: "https://radio-t.com/podcast"}},
+		"message": {AllowedReferers: []string{"radio-t.com"}, Nodes: nodes,
+			RefererDenied: RefererAction{Action: RefererMessage, Message: "<h1>listen on radio-t.com</h1>"}},
+		"unchecked": {AllowEmptyReferer: true, Nodes: nodes},
+	}}
+	warnings, err := conf.Validate()
+	require.NoError(t, err)
+	assert.Equal(t, []Issue{{Service: "unchecked", Field: "allowed_referers", Message: "no allowed referers, referer not checked"}},
+		warnings)
+
+	conf = ConfFile{Services: ServicesMap{
+		"bad": {AllowedReferers: []string{"radio-t.com:443", "http://radio-t.com"}, Nodes: nodes,
+			RefererDenied: RefererAction{Action: "block"}},
+		"no-url":     {AllowedReferers: []string{"radio-t.com"}, Nodes: nodes, RefererDenied: RefererAction{Action: RefererRedirect}},
+		"no-message": {AllowedReferers: []string{"radio-t.com"}, Nodes: nodes, RefererDenied: RefererAction{Action: RefererMessage}},
+	}}
+	_, err = conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "allowed_referers", Message: `invalid referer "radio-t.com:443", should be a host name or *.domain pattern`},
+		{Service: "bad", Field: "allowed_referers", Message: `invalid referer "http://radio-t.com", should be a host name or *.domain pattern`},
+		{Service: "bad", Field: "referer_denied.action", Message: `unsupported action "block", allowed forbidden, redirect or message`},
+		{Service: "no-message", Field: "referer_denied.message", Message: "empty message"},
+		{Service: "no-url", Field: "referer_denied.url", Message: `invalid url "", should be http(s)://host[:port][/path]`},
+	}, verr.Issues)
+}
+
+func TestValidate_Stats(t *testing.T) {
+	conf := ConfFile{
+		Services: ServicesMap{"svc": {Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}}},
+		Stats: []StatsSinkParams{
+			{Type: "http", URL: "http://stats.example.com/api"},
+			{Type: "file", Path: "/var/log/rlb/stats.ndjson", MaxSize: 100, MaxBackups: 3},
+			{Type: "syslog"},
+			{Type: "syslog", Network: "udp", Address: "localhost:514", Tag: "rlb"},
+			{Type: "http", URL: "stats.example.com"},
+			{Type: "file", MaxSize: -1},
+			{Type: "syslog", Network: "udp"},
+			{Type: "syslog", Network: "blah", Address: "localhost:514"},
+			{Type: "syslog", Address: "localhost:514"},
+			{Type: "kafka"},
+			{Type: "store", Path: "/srv/var/stats.json", Bucket: time.Hour, Retention: 24 * time.Hour},
+			{Type: "store", Bucket: time.Hour, Retention: time.Minute},
+			{Type: "http", URL: "http://stats.example.com/api", Format: "single"},
+			{Type: "http", URL: "http://stats.example.com/api", Format: "ndjson"},
+			{Type: "store", Bucket: 500 * time.Millisecond},
+			{Type: "store", Bucket: 1500 * time.Millisecond},
+		},
+	}
+
+	_, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Field: "stats #5", Message: `invalid url "stats.example.com", should be http(s)://host[:port][/path]`},
+		{Field: "stats #6", Message: "empty path"},
+		{Field: "stats #6", Message: "negative max_size -1 or max_backups 0"},
+		{Field: "stats #7", Message: "empty address for udp network"},
+		{Field: "stats #8", Message: `unsupported network "blah", allowed udp, tcp, unix or unixgram`},
+		{Field: "stats #9", Message: "address requires network"},
+		{Field: "stats #10", Message: `unsupported type "kafka", allowed http, file, syslog or store`},
+		{Field: "stats #12", Message: "retention 1m0s shorter than bucket 1h0m0s"},
+		{Field: "stats #12", Message: "only one store allowed"},
+		{Field: "stats #14", Message: `unsupported format "ndjson", allowed batch or single`},
+		{Field: "stats #15", Message: "bucket 500ms should be a whole number of seconds, at least 1s"},
+		{Field: "stats #15", Message: "only one store allowed"},
+		{Field: "stats #16", Message: "bucket 1.5s should be a whole number of seconds, at least 1s"},
+		{Field: "stats #16", Message: "only one store allowed"},
+	}, verr.Issues)
+}
+
+func TestValidate_Breaker(t *testing.T) {
+	conf := ConfFile{Services: ServicesMap{
+		"bad": {Breaker: BreakerParams{FailureRatio: 1.5, MinRequests: -1, Window: -time.Second},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+		"no-failback": {Breaker: BreakerParams{FailureRatio: 0.5},
+			Nodes: []Node{{Server: "http://n1.radio-t.com", Weight: 1}}},
+	}}
+
+	warnings, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "breaker.failure_ratio", Message: "failure ratio 1.5 out of [0..1] range"},
+		{Service: "bad", Field: "breaker", Message: "negative min_requests -1 or half_open_trials 0"},
+		{Service: "bad", Field: "breaker", Message: "negative window -1s or open_duration 0s"},
+	}, verr.Issues)
+	assert.Equal(t, []Issue{
+		{Service: "bad", Field: "breaker", Message: "breaker needs failback probes, ignored without failback"},
+		{Service: "no-failback", Field: "breaker", Message: "breaker needs failback probes, ignored without failback"},
+	}, warnings)
+}
+
+func TestStatusList(t *testing.T) {
+	tbl := []struct {
+		yml    string
+		res    StatusList
+		str    string
+		hasErr bool
+	}{
+		{"expect_status: 200", StatusList{{200, 200}}, "200", false},
+		{"expect_status: 200-299", StatusList{{200, 299}}, "200-299", false},
+		{"expect_status: [200, 204, \"300 - 302\"]", StatusList{{200, 200}, {204, 204}, {300, 302}}, "200,204,300-302", false},
+		{"expect_status: blah", nil, "", true},
+		{"expect_status: 200-blah", nil, "", true},
+	}
+
+	for i, tt := range tbl {
+		n := Node{}
+		err := yaml.Unmarshal([]byte(tt.yml), &n)
+		if tt.hasErr {
+			assert.Error(t, err, "#%d", i)
+			continue
+		}
+		require.NoError(t, err, "#%d", i)
+		assert.Equal(t, tt.res, n.ExpectStatus, "#%d", i)
+		assert.Equal(t, tt.str, n.ExpectStatus.String(), "#%d", i)
+	}
+
+	assert.True(t, StatusList{}.Match(302), "any code below 400 by default")
+	assert.False(t, StatusList{}.Match(404))
+	assert.True(t, StatusList{{200, 200}, {300, 399}}.Match(302))
+	assert.False(t, StatusList{{200, 200}, {300, 399}}.Match(204))
+}
+
+func TestValidate_Check(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a cert"), 0o600))
+
+	conf := ConfFile{Services: ServicesMap{"svc": {Nodes: []Node{
+		{Server: "http://n1.radio-t.com", Weight: 1, Method: "GET", ExpectStatus: StatusList{{200, 299}},
+			ExpectBody: "ok", ExpectBodyRe: "^ok$", Headers: map[string]string{"Host": "n1"}, InsecureSkipVerify: true},
+		{Server: "http://n2.radio-t.com", Weight: 1, ExpectStatus: StatusList{{99, 200}, {300, 200}}, ExpectBody: "ok"},
+		{Server: "http://n3.radio-t.com", Weight: 1, Method: "GET", ExpectBodyRe: "ok(", CAFile: caFile},
+		{Server: "http://n4.radio-t.com", Weight: 1, CAFile: "/no-such-file.pem"},
+		{Server: "http://n5.radio-t.com", Weight: 1, Method: "tcp", ExpectStatus: StatusList{{200, 200}}},
+		{Server: "http://n6.radio-t.com", Weight: 1, Method: "dns"},
+	}}}}
+
+	_, err := conf.Validate()
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.Len(t, verr.Issues, 7, verr.Error())
+	assert.Equal(t, Issue{Service: "svc", Node: 2, Field: "expect_status", Message: "invalid status range 99-200"}, verr.Issues[0])
+	assert.Equal(t, Issue{Service: "svc", Node: 2, Field: "expect_status", Message: "invalid status range 300-200"}, verr.Issues[1])
+	assert.Equal(t, Issue{Service: "svc", Node: 2, Field: "method", Message: "body expectations require GET method"}, verr.Issues[2])
+	assert.Equal(t, 3, verr.Issues[3].Node)
+	assert.Equal(t, "expect_body_re", verr.Issues[3].Field)
+	assert.Equal(t, Issue{Service: "svc", Node: 3, Field: "ca_file", Message: "no PEM certificates in " + caFile}, verr.Issues[4])
+	assert.Equal(t, 4, verr.Issues[5].Node)
+	assert.Contains(t, verr.Issues[5].Message, "can't read CA file")
+	assert.Equal(t, Issue{Service: "svc", Node: 5, Field: "method", Message: "expected status requires HEAD or GET method"}, verr.Issues[6])
+}
+
 const rlbYaml = `
 services:
  test1:
@@ -38,15 +391,32 @@ services:
     weight: 5
 
  test2:
-  - server: http://n5.radio-t.com
-    ping: /rtfiles/rt_podcast480.mp3
-    method: GET
-    weight: 1
+  strategy: hash
+  rise: 2
+  fall: 3
+  interval: 10s
+  timeout: 2s
+  redirect_code: 307
+  cache_max_age: 1h
+  passive:
+   fails: 3
+   cooldown: 30s
+  breaker:
+   failure_ratio: 0.5
+   open_duration: 10s
+  nodes:
+   - server: http://n5.radio-t.com
+     ping: /rtfiles/rt_podcast480.mp3
+     method: GET
+     weight: 1
 
-  - server: http://n2.radio-t.com
-    ping: /rtfiles/rt_podcast480.mp3
-    method: GET
-    weight: 3
+   - server: http://n2.radio-t.com
+     ping: /rtfiles/rt_podcast480.mp3
+     method: GET
+     weight: 3
+     rise: 5
+     timeout: 15s
+     jitter: 1s
 
 no_node:
  message: blah
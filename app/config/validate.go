@@ -0,0 +1,429 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Issue describes a problem found in config. Node is 1-based position of the node in service, 0 for non-node issues
+type Issue struct {
+	Service string
+	Node    int
+	Field   string
+	Message string
+}
+
+// ValidationError lists all errors found in config
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (i Issue) String() string {
+	var loc []string
+	if i.Service != "" {
+		loc = append(loc, "service "+i.Service)
+	}
+	if i.Node > 0 {
+		loc = append(loc, fmt.Sprintf("node #%d", i.Node))
+	}
+	if i.Field != "" {
+		loc = append(loc, i.Field)
+	}
+	if len(loc) == 0 {
+		return i.Message
+	}
+	return strings.Join(loc, ", ") + ": " + i.Message
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Issues))
+	for _, i := range e.Issues {
+		msgs = append(msgs, i.String())
+	}
+	return fmt.Sprintf("invalid config, %d error(s): %s", len(e.Issues), strings.Join(msgs, "; "))
+}
+
+// Validate checks config for semantic errors. Returns *ValidationError with all errors found,
+// and list of warnings for things allowed but most likely wrong, like service with all zero weights.
+func (c ConfFile) Validate() (warnings []Issue, err error) {
+	var errs []Issue
+
+	if len(c.Services) == 0 {
+		errs = append(errs, Issue{Field: "services", Message: "no services defined"})
+	}
+
+	if c.FailBackURL != "" {
+		if e := checkServerURL(c.FailBackURL); e != nil {
+			errs = append(errs, Issue{Field: "failback", Message: e.Error()})
+		}
+	}
+
+	stores := 0
+	for i, sink := range c.Stats {
+		errs = append(errs, sink.validate(i+1)...)
+		if sink.Type == SinkStore {
+			if stores++; stores > 1 {
+				errs = append(errs, Issue{Field: fmt.Sprintf("stats #%d", i+1), Message: "only one store allowed"})
+			}
+		}
+	}
+
+	errs = append(errs, c.validateHosts()...)
+
+	services := make([]string, 0, len(c.Services))
+	for svc := range c.Services {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	for _, svc := range services {
+		svcErrs, svcWarnings := c.Services[svc].validate(svc)
+		errs = append(errs, svcErrs...)
+		warnings = append(warnings, svcWarnings...)
+		if c.Services[svc].Passive.Fails > 0 && c.FailBackURL == "" {
+			warnings = append(warnings, Issue{Service: svc, Field: "passive",
+				Message: "passive checks need failback probes, ignored without failback"})
+		}
+		if c.Services[svc].Breaker.FailureRatio > 0 && c.FailBackURL == "" {
+			warnings = append(warnings, Issue{Service: svc, Field: "breaker",
+				Message: "breaker needs failback probes, ignored without failback"})
+		}
+		if sign := c.Services[svc].Sign; (sign.Secret != "" && len(sign.Secret) < minSecretLen) ||
+			(sign.NodeSecret != "" && len(sign.NodeSecret) < minSecretLen) {
+			warnings = append(warnings, Issue{Service: svc, Field: "sign",
+				Message: fmt.Sprintf("secret shorter than %d chars is easy to guess", minSecretLen)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return warnings, &ValidationError{Issues: errs}
+	}
+	return warnings, nil
+}
+
+// validate checks service and all its nodes
+func (s Service) validate(svc string) (errs, warnings []Issue) {
+	switch s.Strategy {
+	case "", StrategyRandom, StrategyRoundRobin, StrategyHash:
+	default:
+		errs = append(errs, Issue{Service: svc, Field: "strategy",
+			Message: fmt.Sprintf("unsupported strategy %q, allowed %s, %s or %s",
+				s.Strategy, StrategyRandom, StrategyRoundRobin, StrategyHash)})
+	}
+
+	if s.Rise < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "rise", Message: fmt.Sprintf("negative rise %d", s.Rise)})
+	}
+	if s.Fall < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "fall", Message: fmt.Sprintf("negative fall %d", s.Fall)})
+	}
+
+	if s.Passive.Fails < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "passive.fails", Message: fmt.Sprintf("negative fails %d", s.Passive.Fails)})
+	}
+	if s.Passive.Cooldown < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "passive.cooldown",
+			Message: fmt.Sprintf("negative cooldown %v", s.Passive.Cooldown)})
+	}
+
+	errs = append(errs, s.Breaker.validate(svc)...)
+	errs = append(errs, s.validateRedirect(svc)...)
+	if s.Sign.NodeTTL < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "sign.node_ttl", Message: fmt.Sprintf("negative node ttl %v", s.Sign.NodeTTL)})
+	}
+	refErrs, refWarnings := s.validateReferers(svc)
+	errs, warnings = append(errs, refErrs...), append(warnings, refWarnings...)
+	for _, re := range s.AllowedPaths {
+		if _, err := regexp.Compile(re); err != nil {
+			errs = append(errs, Issue{Service: svc, Field: "allowed_paths", Message: err.Error()})
+		}
+	}
+	if s.Interval < 0 || s.Timeout < 0 || s.Jitter < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "interval",
+			Message: fmt.Sprintf("negative interval %v, timeout %v or jitter %v", s.Interval, s.Timeout, s.Jitter)})
+	}
+
+	if len(s.Nodes) == 0 {
+		errs = append(errs, Issue{Service: svc, Message: "no nodes defined"})
+		return errs, warnings
+	}
+
+	totalWeight := 0
+	servers := map[string]int{}
+	for i, n := range s.Nodes {
+		pos := i + 1
+		errs = append(errs, n.validate(svc, pos)...)
+		if n.Weight > 0 {
+			totalWeight += n.Weight
+		}
+		if prev, ok := servers[n.Server]; ok && n.Server != "" {
+			warnings = append(warnings, Issue{Service: svc, Node: pos, Field: "server",
+				Message: fmt.Sprintf("duplicate server %s, same as node #%d", n.Server, prev)})
+			continue
+		}
+		servers[n.Server] = pos
+	}
+
+	if totalWeight == 0 {
+		warnings = append(warnings, Issue{Service: svc, Field: "weight", Message: "all weights are 0, service never served"})
+	}
+	return errs, warnings
+}
+
+// validate checks stats sink, pos is 1-based position of the sink in the list
+func (p StatsSinkParams) validate(pos int) (errs []Issue) {
+	field := fmt.Sprintf("stats #%d", pos)
+	switch p.Type {
+	case SinkHTTP:
+		if err := checkServerURL(p.URL); err != nil {
+			errs = append(errs, Issue{Field: field, Message: err.Error()})
+		}
+		if p.Format != "" && p.Format != FormatBatch && p.Format != FormatSingle {
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("unsupported format %q, allowed %s or %s", p.Format, FormatBatch, FormatSingle)})
+		}
+	case SinkFile:
+		if p.Path == "" {
+			errs = append(errs, Issue{Field: field, Message: "empty path"})
+		}
+		if p.MaxSize < 0 || p.MaxBackups < 0 {
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("negative max_size %d or max_backups %d", p.MaxSize, p.MaxBackups)})
+		}
+	case SinkSyslog:
+		switch p.Network {
+		case "":
+			if p.Address != "" {
+				errs = append(errs, Issue{Field: field, Message: "address requires network"})
+			}
+		case "udp", "tcp", "unix", "unixgram":
+			if p.Address == "" {
+				errs = append(errs, Issue{Field: field, Message: fmt.Sprintf("empty address for %s network", p.Network)})
+			}
+		default:
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("unsupported network %q, allowed udp, tcp, unix or unixgram", p.Network)})
+		}
+	case SinkStore:
+		if p.Bucket < 0 || p.Retention < 0 {
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("negative bucket %v or retention %v", p.Bucket, p.Retention)})
+		}
+		if p.Bucket > 0 && (p.Bucket < time.Second || p.Bucket%time.Second != 0) {
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("bucket %v should be a whole number of seconds, at least 1s", p.Bucket)})
+		}
+		if p.Bucket > 0 && p.Retention > 0 && p.Retention < p.Bucket {
+			errs = append(errs, Issue{Field: field,
+				Message: fmt.Sprintf("retention %v shorter than bucket %v", p.Retention, p.Bucket)})
+		}
+	default:
+		errs = append(errs, Issue{Field: field, Message: fmt.Sprintf("unsupported type %q, allowed %s, %s, %s or %s",
+			p.Type, SinkHTTP, SinkFile, SinkSyslog, SinkStore)})
+	}
+	return errs
+}
+
+// minSecretLen is a length of signing secret considered safe
+const minSecretLen = 16
+
+// hostRe matches host name or wildcard pattern of its subdomains, like *.example.com, no port
+var hostRe = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validateHosts checks host patterns and their services, hosts are case-insensitive
+func (c ConfFile) validateHosts() (errs []Issue) {
+	hosts := make([]string, 0, len(c.Hosts))
+	for host := range c.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		field := "hosts " + host
+		if !hostRe.MatchString(strings.ToLower(host)) {
+			errs = append(errs, Issue{Field: field, Message: "invalid host, should be a host name or *.domain pattern"})
+		}
+		if seen[strings.ToLower(host)] {
+			errs = append(errs, Issue{Field: field, Message: "duplicate host"})
+		}
+		seen[strings.ToLower(host)] = true
+		if _, ok := c.Services[c.Hosts[host]]; !ok {
+			errs = append(errs, Issue{Field: field, Message: fmt.Sprintf("unknown service %q", c.Hosts[host])})
+		}
+	}
+	return errs
+}
+
+// validateRedirect checks redirect code and cache max-age
+func (s Service) validateRedirect(svc string) (errs []Issue) {
+	switch s.RedirectCode {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		errs = append(errs, Issue{Service: svc, Field: "redirect_code",
+			Message: fmt.Sprintf("unsupported redirect code %d, allowed 301, 302, 303, 307 or 308", s.RedirectCode)})
+	}
+	if s.CacheMaxAge < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "cache_max_age",
+			Message: fmt.Sprintf("negative cache max-age %v", s.CacheMaxAge)})
+	}
+	return errs
+}
+
+// validateReferers checks referer patterns and the response to referer not allowed
+func (s Service) validateReferers(svc string) (errs, warnings []Issue) {
+	for _, ref := range s.AllowedReferers {
+		if !hostRe.MatchString(strings.ToLower(ref)) {
+			errs = append(errs, Issue{Service: svc, Field: "allowed_referers",
+				Message: fmt.Sprintf("invalid referer %q, should be a host name or *.domain pattern", ref)})
+		}
+	}
+
+	switch s.RefererDenied.Action {
+	case "", RefererForbidden:
+	case RefererRedirect:
+		if e := checkServerURL(s.RefererDenied.URL); e != nil {
+			errs = append(errs, Issue{Service: svc, Field: "referer_denied.url", Message: e.Error()})
+		}
+	case RefererMessage:
+		if s.RefererDenied.Message == "" {
+			errs = append(errs, Issue{Service: svc, Field: "referer_denied.message", Message: "empty message"})
+		}
+	default:
+		errs = append(errs, Issue{Service: svc, Field: "referer_denied.action",
+			Message: fmt.Sprintf("unsupported action %q, allowed %s, %s or %s",
+				s.RefererDenied.Action, RefererForbidden, RefererRedirect, RefererMessage)})
+	}
+
+	if len(s.AllowedReferers) == 0 && (s.AllowEmptyReferer || s.RefererDenied != RefererAction{}) {
+		warnings = append(warnings, Issue{Service: svc, Field: "allowed_referers",
+			Message: "no allowed referers, referer not checked"})
+	}
+	return errs, warnings
+}
+
+// validate checks breaker params
+func (b BreakerParams) validate(svc string) (errs []Issue) {
+	if b.FailureRatio < 0 || b.FailureRatio > 1 {
+		errs = append(errs, Issue{Service: svc, Field: "breaker.failure_ratio",
+			Message: fmt.Sprintf("failure ratio %v out of [0..1] range", b.FailureRatio)})
+	}
+	if b.MinRequests < 0 || b.HalfOpenTrials < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "breaker",
+			Message: fmt.Sprintf("negative min_requests %d or half_open_trials %d", b.MinRequests, b.HalfOpenTrials)})
+	}
+	if b.Window < 0 || b.OpenDuration < 0 {
+		errs = append(errs, Issue{Service: svc, Field: "breaker",
+			Message: fmt.Sprintf("negative window %v or open_duration %v", b.Window, b.OpenDuration)})
+	}
+	return errs
+}
+
+// validate checks a single node, svc and pos used to report position of the node
+func (n Node) validate(svc string, pos int) (errs []Issue) {
+	if n.Server == "" {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "server", Message: "empty server"})
+	} else if err := checkServerURL(n.Server); err != nil {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "server", Message: err.Error()})
+	}
+
+	if n.Ping != "" && !strings.HasPrefix(n.Ping, "/") {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "ping",
+			Message: fmt.Sprintf("ping %q should start with /", n.Ping)})
+	}
+
+	if n.Weight < 0 {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "weight",
+			Message: fmt.Sprintf("negative weight %d", n.Weight)})
+	}
+
+	errs = append(errs, n.validateSchedule(svc, pos)...)
+
+	switch n.Method {
+	case "", "HEAD", "GET", MethodTCP, MethodDNS:
+	default:
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "method",
+			Message: fmt.Sprintf("unsupported method %q, allowed HEAD, GET, %s or %s", n.Method, MethodTCP, MethodDNS)})
+	}
+
+	return append(errs, n.validateCheck(svc, pos)...)
+}
+
+// validateSchedule checks node's check timing and thresholds
+func (n Node) validateSchedule(svc string, pos int) (errs []Issue) {
+	if n.Rise < 0 {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "rise", Message: fmt.Sprintf("negative rise %d", n.Rise)})
+	}
+	if n.Fall < 0 {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "fall", Message: fmt.Sprintf("negative fall %d", n.Fall)})
+	}
+
+	if n.Interval < 0 || n.Timeout < 0 || n.Jitter < 0 {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "interval",
+			Message: fmt.Sprintf("negative interval %v, timeout %v or jitter %v", n.Interval, n.Timeout, n.Jitter)})
+	}
+	return errs
+}
+
+// validateCheck checks node's health check expectations and TLS options
+func (n Node) validateCheck(svc string, pos int) (errs []Issue) {
+	for _, r := range n.ExpectStatus {
+		if r.From < 100 || r.To > 599 || r.From > r.To {
+			errs = append(errs, Issue{Service: svc, Node: pos, Field: "expect_status",
+				Message: fmt.Sprintf("invalid status range %d-%d", r.From, r.To)})
+		}
+	}
+
+	if len(n.ExpectStatus) > 0 && (n.Method == MethodTCP || n.Method == MethodDNS) {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "method",
+			Message: "expected status requires HEAD or GET method"})
+	}
+	if (n.ExpectBody != "" || n.ExpectBodyRe != "") && n.Method != "GET" {
+		errs = append(errs, Issue{Service: svc, Node: pos, Field: "method",
+			Message: "body expectations require GET method"})
+	}
+	if n.ExpectBodyRe != "" {
+		if _, err := regexp.Compile(n.ExpectBodyRe); err != nil {
+			errs = append(errs, Issue{Service: svc, Node: pos, Field: "expect_body_re", Message: err.Error()})
+		}
+	}
+
+	if n.CAFile != "" {
+		if err := checkCAFile(n.CAFile); err != nil {
+			errs = append(errs, Issue{Service: svc, Node: pos, Field: "ca_file", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// checkCAFile verifies file has at least one PEM certificate
+func checkCAFile(fname string) error {
+	data, err := os.ReadFile(fname) // nolint:gosec // file name comes from the config
+	if err != nil {
+		return fmt.Errorf("can't read CA file: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates in %s", fname)
+	}
+	return nil
+}
+
+// checkServerURL verifies server is an absolute http(s) url
+func checkServerURL(server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, should be http(s)://host[:port][/path]", server)
+	}
+	return nil
+}
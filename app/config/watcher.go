@@ -0,0 +1,101 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// Watcher monitors config file and calls onChange with a newly loaded config on every change.
+// Broken config rejected with a warning and the current one stays active.
+type Watcher struct {
+	fname    string
+	interval time.Duration
+	onChange func(conf *ConfFile)
+	trigger  chan struct{}
+
+	modTime time.Time
+	size    int64
+}
+
+// NewWatcher makes config watcher for fname. Zero interval disables file polling, reload can be forced with Reload
+func NewWatcher(fname string, interval time.Duration, onChange func(conf *ConfFile)) *Watcher {
+	return &Watcher{fname: fname, interval: interval, onChange: onChange, trigger: make(chan struct{}, 1)}
+}
+
+// Run polls config file for changes till context canceled. Blocking call.
+func (w *Watcher) Run(ctx context.Context) {
+	log.Printf("[DEBUG] config watcher started for %s, interval=%v", w.fname, w.interval)
+	w.changed() // remember initial state of the file
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("[DEBUG] config watcher for %s terminated", w.fname)
+			return
+		case <-tick:
+			if w.changed() {
+				log.Printf("[INFO] config %s changed", w.fname)
+				w.reload()
+			}
+		case <-w.trigger:
+			log.Printf("[INFO] config %s reload requested", w.fname)
+			w.changed()
+			w.reload()
+		}
+	}
+}
+
+// Reload forces config reload regardless of the file state, i.e. on SIGHUP
+func (w *Watcher) Reload() {
+	select {
+	case w.trigger <- struct{}{}:
+	default: // reload already pending
+	}
+}
+
+// changed checks if modification time or size of the file differ from the last seen
+func (w *Watcher) changed() bool {
+	fi, err := os.Stat(w.fname)
+	if err != nil {
+		log.Printf("[WARN] can't stat config %s, %v", w.fname, err)
+		return false
+	}
+	if fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+	return true
+}
+
+func (w *Watcher) reload() {
+	fh, err := os.Open(w.fname)
+	if err != nil {
+		log.Printf("[WARN] failed to open config %s, %v, keep the current one", w.fname, err)
+		return
+	}
+	defer func() {
+		if e := fh.Close(); e != nil {
+			log.Printf("[WARN] failed to close %s, %v", w.fname, e)
+		}
+	}()
+
+	conf, warnings, err := Load(fh)
+	for _, warn := range warnings {
+		log.Printf("[WARN] config %s, %s", w.fname, warn)
+	}
+	if err != nil {
+		log.Printf("[WARN] rejected config %s, %v, keep the current one", w.fname, err)
+		return
+	}
+	w.onChange(conf)
+}
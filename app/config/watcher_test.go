@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "rlb.yml")
+	require.NoError(t, os.WriteFile(fname, []byte(rlbYaml), 0o600))
+
+	var lock sync.Mutex
+	var loaded []*ConfFile
+	w := NewWatcher(fname, 10*time.Millisecond, func(conf *ConfFile) {
+		lock.Lock()
+		loaded = append(loaded, conf)
+		lock.Unlock()
+	})
+	loadedCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(loaded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, loadedCount(), "no reload for unchanged file")
+
+	updated := strings.Replace(rlbYaml, "weight: 5", "weight: 50", 1)
+	require.NoError(t, os.WriteFile(fname, []byte(updated), 0o600))
+	require.Eventually(t, func() bool { return loadedCount() == 1 }, time.Second, 10*time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, "http://archive.radio-t.com/media", loaded[0].FailBackURL)
+	lock.Unlock()
+
+	// broken config rejected
+	require.NoError(t, os.WriteFile(fname, []byte("services: [blah\n bad"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, loadedCount(), "broken config not reported")
+
+	// forced reload of the fixed config
+	require.NoError(t, os.WriteFile(fname, []byte(rlbYaml), 0o600))
+	w.Reload()
+	require.Eventually(t, func() bool { return loadedCount() >= 2 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher not terminated")
+	}
+}
+
+func TestWatcher_ReloadWithoutPolling(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "rlb.yml")
+	require.NoError(t, os.WriteFile(fname, []byte(rlbYaml), 0o600))
+
+	reloaded := make(chan *ConfFile, 1)
+	w := NewWatcher(fname, 0, func(conf *ConfFile) { reloaded <- conf })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Reload()
+	select {
+	case conf := <-reloaded:
+		assert.Equal(t, "blah", conf.NoNode.Message)
+	case <-time.After(time.Second):
+		t.Fatal("config not reloaded")
+	}
+}
@@ -2,8 +2,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -20,31 +24,170 @@ var opts struct {
 	Refresh  time.Duration `short:"r" long:"refresh" env:"REFRESH" default:"30s" description:"refresh interval"`
 	TimeOut  time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"5s" description:"HEAD/GET timeouts"`
 	StatsURL string        `short:"s" long:"stats" env:"STATS" default:"" description:"stats url"`
+	Watch    time.Duration `short:"w" long:"watch" env:"WATCH" default:"5s" description:"config watch interval, 0 to disable"`
+	Drain    time.Duration `long:"drain" env:"DRAIN" default:"5s" description:"period to report not-ready before shutdown"`
+	Shutdown time.Duration `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"10s" description:"max wait for in-flight requests on shutdown"`
+	Trusted  []string      `long:"trusted-proxy" env:"TRUSTED_PROXY" env-delim:"," description:"trusted proxy CIDR or ip, client ip taken from its forwarding headers"`
 	Dbg      bool          `long:"dbg" env:"DEBUG" description:"debug mode"`
+
+	Stats struct {
+		Queue   int           `long:"queue" env:"QUEUE" default:"10000" description:"max records waiting for submission to a sink"`
+		Workers int           `long:"workers" env:"WORKERS" default:"2" description:"number of concurrent submitters of a sink"`
+		Batch   int           `long:"batch" env:"BATCH" default:"100" description:"max records in a request"`
+		Flush   time.Duration `long:"flush" env:"FLUSH" default:"1s" description:"max time a record waits for a batch"`
+		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"http sink request timeout"`
+		Retries int           `long:"retries" env:"RETRIES" default:"3" description:"retries of a failed batch"`
+		Backoff time.Duration `long:"backoff" env:"BACKOFF" default:"500ms" description:"delay before the first retry"`
+	} `group:"stats" namespace:"stats" env-namespace:"STATS"`
+
+	Check struct{} `command:"check" description:"validate config, check all nodes once and exit"`
+
+	Sign struct {
+		Svc  string        `long:"svc" required:"true" description:"service of the link"`
+		TTL  time.Duration `long:"ttl" default:"24h" description:"link lifetime"`
+		Base string        `long:"base" default:"http://localhost:7070" description:"rlb url, or service's host url with --host"`
+		Host bool          `long:"host" description:"link to service's own host, without jump prefix"`
+		Args struct {
+			Resource string `positional-arg-name:"resource" required:"yes" description:"resource, i.e. /rtfiles/rt_podcast480.mp3"`
+		} `positional-args:"yes"`
+	} `command:"sign" description:"print signed link to resource of the service and exit"`
 }
 
 var revision = "unknown"
 
 func main() {
 	log.Printf("RLB - %s", revision)
-	if _, err := flags.Parse(&opts); err != nil {
+	p := flags.NewParser(&opts, flags.Default)
+	p.SubcommandsOptional = true
+	if _, err := p.Parse(); err != nil {
 		os.Exit(1)
 	}
 
 	setupLog(opts.Dbg)
 
+	if p.Active != nil && p.Active.Name == "check" {
+		os.Exit(runCheck(opts.Conf, opts.TimeOut, os.Stdout))
+	}
+	if p.Active != nil && p.Active.Name == "sign" {
+		os.Exit(runSign(opts.Conf, signParams{svc: opts.Sign.Svc, resource: opts.Sign.Args.Resource, base: opts.Sign.Base,
+			host: opts.Sign.Host, ttl: opts.Sign.TTL}, os.Stdout))
+	}
+
 	confReader, err := os.Open(opts.Conf)
 	if err != nil {
 		log.Fatalf("[PANIC] failed to open %s, %v", opts.Conf, err)
 	}
 
-	conf := config.NewConf(confReader)
-	if err := confReader.Close(); err != nil {
-		log.Printf("[WARN] failed to close %s, %s", opts.Conf, err.Error())
+	conf, warnings, err := config.Load(confReader)
+	if e := confReader.Close(); e != nil {
+		log.Printf("[WARN] failed to close %s, %s", opts.Conf, e.Error())
+	}
+	for _, w := range warnings {
+		log.Printf("[WARN] config %s, %s", opts.Conf, w)
+	}
+	if err != nil {
+		log.Fatalf("[PANIC] failed to load %s, %v", opts.Conf, err)
+	}
+
+	// SIGTERM or interrupt stops config watcher and drains http server,
+	// health checks keep running till the server stopped, so requests in the drain period get alive nodes
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	trusted, err := server.ParseTrustedProxies(opts.Trusted)
+	if err != nil {
+		log.Fatalf("[PANIC] %v", err)
+	}
+
+	services := conf.Get()
+	pck := picker.New(context.Background(), services, opts.Refresh, opts.TimeOut, strings.TrimSuffix(conf.FailBackURL, "/"))
+	sinks, err := makeStatsSinks(conf.Stats, opts.StatsURL, opts.Stats.Timeout)
+	if err != nil {
+		log.Fatalf("[PANIC] failed to make stats sinks, %v", err)
+	}
+	var stats *server.Stats
+	var store *server.StatsStore
+	for _, sink := range sinks {
+		if s, ok := sink.(*server.StatsStore); ok {
+			store = s
+		}
+	}
+	if len(sinks) > 0 {
+		stats = server.NewStats(server.StatsParams{QueueSize: opts.Stats.Queue, Workers: opts.Stats.Workers,
+			BatchSize: opts.Stats.Batch, FlushInterval: opts.Stats.Flush, Retries: opts.Stats.Retries,
+			Backoff: opts.Stats.Backoff}, sinks...)
+	}
+	srv := server.NewRLBServer(pck, server.Opts{Port: opts.Port, Version: revision, NoNodeMessage: conf.NoNode.Message,
+		Services: services, Hosts: conf.Hosts, Stats: stats, Store: store, TrustedProxies: trusted})
+
+	watcher := config.NewWatcher(opts.Conf, opts.Watch, func(c *config.ConfFile) {
+		services := c.Get()
+		pck.Update(services, strings.TrimSuffix(c.FailBackURL, "/"))
+		srv.SetNoNodeMessage(c.NoNode.Message)
+		srv.SetServices(services)
+		srv.SetHosts(c.Hosts)
+		log.Printf("[INFO] config %s applied", opts.Conf)
+	})
+	go watcher.Run(ctx)
+	go reloadOnSignal(watcher)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Print("[INFO] termination requested")
+		srv.Shutdown(opts.Drain, opts.Shutdown)
+	}()
+
+	srv.Run()
+	if ctx.Err() != nil {
+		<-shutdownDone // Run returns as soon as listener closed, wait for in-flight requests and stats
+	}
+	pck.Close()
+	log.Print("[INFO] rlb terminated")
+}
+
+// makeStatsSinks makes sinks defined in config, plus http sink for statsURL from command line if defined.
+// Sinks made so far closed on error.
+func makeStatsSinks(params []config.StatsSinkParams, statsURL string, timeout time.Duration) ([]server.StatsSink, error) {
+	var res []server.StatsSink
+	if statsURL != "" {
+		res = append(res, server.NewHTTPSink(statsURL, timeout, false)) // legacy format, a record per request
 	}
+	for _, p := range params {
+		var sink server.StatsSink
+		var err error
+		switch p.Type {
+		case config.SinkHTTP:
+			sink = server.NewHTTPSink(p.URL, timeout, p.Format != config.FormatSingle)
+		case config.SinkFile:
+			sink, err = server.NewFileSink(p.Path, int64(p.MaxSize)*1024*1024, p.MaxBackups)
+		case config.SinkSyslog:
+			sink, err = server.NewSyslogSink(p.Network, p.Address, p.Tag)
+		case config.SinkStore:
+			sink, err = server.NewStatsStore(server.StoreParams{Path: p.Path, Bucket: p.Bucket, Retention: p.Retention})
+		default:
+			err = fmt.Errorf("unsupported stats sink %q", p.Type)
+		}
+		if err != nil {
+			for _, s := range res {
+				_ = s.Close()
+			}
+			return nil, err
+		}
+		res = append(res, sink)
+	}
+	return res, nil
+}
 
-	pck := picker.NewRandomWeighted(conf.Get(), opts.Refresh, opts.TimeOut, strings.TrimSuffix(conf.FailBackURL, "/"))
-	server.NewRLBServer(pck, conf.NoNode.Message, opts.StatsURL, opts.Port, revision).Run()
+// reloadOnSignal forces config reload on SIGHUP
+func reloadOnSignal(watcher *config.Watcher) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		log.Print("[INFO] SIGHUP received")
+		watcher.Reload()
+	}
 }
 
 func setupLog(dbg bool) {
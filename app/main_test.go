@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/server"
+)
+
+func TestMakeStatsSinks(t *testing.T) {
+	dir := t.TempDir()
+	sinks, err := makeStatsSinks([]config.StatsSinkParams{
+		{Type: config.SinkHTTP, URL: "http://stats2.example.com", Format: config.FormatSingle},
+		{Type: config.SinkFile, Path: filepath.Join(dir, "stats.ndjson"), MaxSize: 1},
+		{Type: config.SinkStore, Path: filepath.Join(dir, "stats.json")},
+	}, "http://stats.example.com", time.Second)
+	require.NoError(t, err)
+	require.Len(t, sinks, 4)
+	assert.Equal(t, "http:http://stats.example.com", sinks[0].String(), "command line url first")
+	assert.Equal(t, "http:http://stats2.example.com", sinks[1].String())
+	assert.Equal(t, "file:"+filepath.Join(dir, "stats.ndjson"), sinks[2].String())
+	assert.IsType(t, &server.StatsStore{}, sinks[3])
+	for _, s := range sinks {
+		assert.NoError(t, s.Close())
+	}
+
+	sinks, err = makeStatsSinks(nil, "", time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, sinks)
+
+	_, err = makeStatsSinks([]config.StatsSinkParams{{Type: config.SinkFile, Path: "/no-such-dir/stats.ndjson"}}, "", time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+// Package metrics defines prometheus metrics of rlb, registered in Default registry and exposed in prometheus text format
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics of rlb, all registered in Default
+var (
+	// Redirects counts redirects by service and picked node
+	Redirects = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_redirects_total",
+		Help: "Redirects by service and node."}, []string{"service", "node"})
+	// NoNode counts 404 responses with no alive node by service
+	NoNode = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_no_node_total",
+		Help: "Responses with no alive node by service."}, []string{"service"})
+	// Failbacks counts requests rerouted to failback url by service
+	Failbacks = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_failback_total",
+		Help: "Requests rerouted to failback url by service."}, []string{"service"})
+	// RefererChecks counts referer checks of services with allowed referers by result, allowed or denied
+	RefererChecks = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_referer_checks_total",
+		Help: "Referer checks by service and result."}, []string{"service", "result"})
+	// Checks counts health check results by service, node and result, success or failure
+	Checks = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_health_checks_total",
+		Help: "Health check results by service, node and result."}, []string{"service", "node", "result"})
+	// CheckDuration observes latency of health checks by service and node
+	CheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "rlb_health_check_duration_seconds",
+		Help: "Health check latency by service and node.", Buckets: prometheus.DefBuckets}, []string{"service", "node"})
+	// NodeAlive is 1 for alive node and 0 for dead one
+	NodeAlive = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rlb_node_alive",
+		Help: "Node alive status, 1 alive, 0 dead."}, []string{"service", "node"})
+	// StatsSubmissions counts stats records submitted to sink by result, success or failure
+	StatsSubmissions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_stats_submissions_total",
+		Help: "Submitted stats records by sink and result."}, []string{"sink", "result"})
+	// StatsDropped counts stats records dropped on overflow of sink's queue
+	StatsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rlb_stats_dropped_total",
+		Help: "Stats records dropped on queue overflow by sink."}, []string{"sink"})
+)
+
+// Default registry with all rlb metrics
+var Default = newRegistry(Redirects, NoNode, Failbacks, RefererChecks, Checks, CheckDuration, NodeAlive,
+	StatsSubmissions, StatsDropped)
+
+// UnknownService is service label of requests to services not defined in config
+const UnknownService = "unknown"
+
+// result label values
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+)
+
+// Result returns result label value for err
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// DeleteNode removes all series of the node, i.e. for node removed on config reload
+func DeleteNode(svc, node string) {
+	labels := prometheus.Labels{"service": svc, "node": node}
+	Redirects.DeletePartialMatch(labels)
+	Checks.DeletePartialMatch(labels)
+	CheckDuration.DeletePartialMatch(labels)
+	NodeAlive.DeletePartialMatch(labels)
+}
+
+// Middleware serves metrics of Default registry on GET path and passes other requests through.
+// Allows /metrics next to catch-all routes like /{svc} the mux would reject as conflicting.
+func Middleware(path string) func(http.Handler) http.Handler {
+	return middleware(Default, path)
+}
+
+func middleware(reg *prometheus.Registry, path string) func(http.Handler) http.Handler {
+	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == path {
+				h.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func newRegistry(collectors ...prometheus.Collector) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	return reg
+}
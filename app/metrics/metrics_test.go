@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Total."})
+	c.Inc()
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("next")) })
+	ts := httptest.NewServer(middleware(newRegistry(c), "/metrics")(next))
+	defer ts.Close()
+
+	get := func(method, path string) string {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close() // nolint
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "# HELP test_total Total.\n# TYPE test_total counter\ntest_total 1\n", get("GET", "/metrics"))
+	assert.Equal(t, "next", get("POST", "/metrics"))
+	assert.Equal(t, "next", get("GET", "/metrics/blah"))
+	assert.Equal(t, "next", get("GET", "/svc"))
+}
+
+func TestDeleteNode(t *testing.T) {
+	Redirects.WithLabelValues("del-svc", "http://n1").Inc()
+	Redirects.WithLabelValues("del-svc", "http://n2").Inc()
+	Checks.WithLabelValues("del-svc", "http://n1", ResultSuccess).Inc()
+	Checks.WithLabelValues("del-svc", "http://n1", ResultFailure).Inc()
+	CheckDuration.WithLabelValues("del-svc", "http://n1").Observe(0.1)
+	NodeAlive.WithLabelValues("del-svc", "http://n1").Set(1)
+
+	DeleteNode("del-svc", "http://n1")
+
+	exp := `# HELP rlb_redirects_total Redirects by service and node.
+# TYPE rlb_redirects_total counter
+rlb_redirects_total{node="http://n2",service="del-svc"} 1
+`
+	require.NoError(t, testutil.CollectAndCompare(Redirects, strings.NewReader(exp), "rlb_redirects_total"))
+	assert.NotContains(t, gather(t), `node="http://n1"`, "all series of n1 deleted")
+	DeleteNode("del-svc", "http://n2")
+}
+
+func TestResult(t *testing.T) {
+	assert.Equal(t, "success", Result(nil))
+	assert.Equal(t, "failure", Result(errors.New("failed")))
+}
+
+func gather(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Middleware("/metrics")(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", http.NoBody))
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
@@ -0,0 +1,122 @@
+package picker
+
+import (
+	"time"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+// BreakerState is a state of node's circuit breaker
+type BreakerState int
+
+// breaker states
+const (
+	BreakerClosed   BreakerState = iota // node in rotation, probe results counted
+	BreakerOpen                         // node out of rotation till retry time
+	BreakerHalfOpen                     // node gets limited number of trial requests, their probes decide
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// MarshalText makes state readable in json
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// breaker is a per-node circuit breaker driven by failback probes of real requests.
+// Closed breaker counts probes in the window and opens if failed ratio reaches FailureRatio with at least MinRequests.
+// Open breaker keeps the node out of rotation for OpenDuration and becomes half-open after that.
+// Half-open breaker lets HalfOpenTrials requests to the node, closes after the same number of successful probes
+// in a row, any failed probe opens it again.
+type breaker struct {
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	trials      int       // successful probes in half-open state
+	picked      int       // trial requests picked in half-open state
+	budget      int       // max trial requests in half-open state
+	retryAt     time.Time // open breaker becomes half-open at this time
+}
+
+// current returns breaker state at now, open breaker becomes half-open after retry time
+func (b *breaker) current(now time.Time) BreakerState {
+	if b.state == BreakerOpen && !now.Before(b.retryAt) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// pickable returns true if the node can get a request, i.e. breaker is closed, or half-open with trial requests left
+func (b *breaker) pickable(now time.Time) bool {
+	switch b.current(now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.picked < b.budget
+	default:
+		return true
+	}
+}
+
+// takeTrial counts trial request picked in half-open state, returns false if no trials left.
+// Always true for breaker not half-open.
+func (b *breaker) takeTrial(now time.Time) bool {
+	if b.current(now) != BreakerHalfOpen {
+		return true
+	}
+	if b.picked >= b.budget {
+		return false
+	}
+	b.picked++
+	return true
+}
+
+// record probe result, returns true if breaker opened or closed
+func (b *breaker) record(err error, params config.BreakerParams, now time.Time) bool {
+	if params.FailureRatio <= 0 {
+		return false
+	}
+
+	switch b.current(now) {
+	case BreakerClosed:
+		if b.windowStart.IsZero() || now.Sub(b.windowStart) >= params.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if err != nil {
+			b.failures++
+		}
+		if b.requests >= params.MinRequests && float64(b.failures)/float64(b.requests) >= params.FailureRatio {
+			b.open(params, now)
+			return true
+		}
+	case BreakerHalfOpen:
+		b.state = BreakerHalfOpen
+		if err != nil {
+			b.open(params, now)
+			return true
+		}
+		b.trials++
+		if b.trials >= params.HalfOpenTrials {
+			*b = breaker{state: BreakerClosed}
+			return true
+		}
+	case BreakerOpen:
+		// probe of a request picked before the breaker opened, ignored
+	}
+	return false
+}
+
+func (b *breaker) open(params config.BreakerParams, now time.Time) {
+	*b = breaker{state: BreakerOpen, retryAt: now.Add(params.OpenDuration), budget: max(params.HalfOpenTrials, 1)}
+}
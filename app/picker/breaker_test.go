@@ -0,0 +1,80 @@
+package picker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+func TestBreaker(t *testing.T) {
+	fail := fmt.Errorf("failed")
+	params := config.BreakerParams{FailureRatio: 0.5, MinRequests: 4, Window: time.Minute,
+		OpenDuration: 30 * time.Second, HalfOpenTrials: 2}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := breaker{}
+
+	assert.False(t, b.record(fail, params, now))
+	assert.False(t, b.record(fail, params, now))
+	assert.False(t, b.record(fail, params, now), "not enough requests yet")
+	assert.Equal(t, BreakerClosed, b.current(now))
+
+	// window expired, counts reset
+	now = now.Add(time.Minute)
+	assert.False(t, b.record(nil, params, now))
+	assert.False(t, b.record(nil, params, now))
+	assert.False(t, b.record(fail, params, now))
+	assert.True(t, b.record(fail, params, now), "2 of 4 failed, opened")
+	assert.Equal(t, BreakerOpen, b.current(now))
+	assert.Equal(t, now.Add(30*time.Second), b.retryAt)
+	assert.False(t, b.record(nil, params, now), "ignored in open state")
+
+	// half-open after open duration, failed trial opens again
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.current(now))
+	assert.True(t, b.record(fail, params, now))
+	assert.Equal(t, BreakerOpen, b.current(now))
+
+	// successful trials close it
+	now = now.Add(30 * time.Second)
+	assert.False(t, b.record(nil, params, now))
+	assert.Equal(t, BreakerHalfOpen, b.current(now))
+	assert.True(t, b.record(nil, params, now))
+	assert.Equal(t, BreakerClosed, b.current(now))
+
+	// half-open breaker lets limited number of trial requests
+	b.open(params, now)
+	assert.False(t, b.pickable(now))
+	assert.True(t, b.takeTrial(now), "not half-open, not counted")
+	now = now.Add(30 * time.Second)
+	assert.True(t, b.pickable(now))
+	assert.True(t, b.takeTrial(now))
+	assert.True(t, b.pickable(now))
+	assert.True(t, b.takeTrial(now))
+	assert.False(t, b.pickable(now), "all trials picked")
+	assert.False(t, b.takeTrial(now))
+	assert.False(t, b.record(nil, params, now))
+	assert.False(t, b.pickable(now), "waits for the last trial")
+	assert.True(t, b.record(nil, params, now))
+	assert.True(t, b.pickable(now), "closed")
+	assert.True(t, b.takeTrial(now))
+
+	// disabled breaker never opens
+	b = breaker{}
+	for i := 0; i < 10; i++ {
+		assert.False(t, b.record(fail, config.BreakerParams{}, now))
+	}
+	assert.Equal(t, BreakerClosed, b.current(now))
+}
+
+func TestBreakerState_String(t *testing.T) {
+	assert.Equal(t, "closed", BreakerClosed.String())
+	assert.Equal(t, "open", BreakerOpen.String())
+	assert.Equal(t, "half-open", BreakerHalfOpen.String())
+	txt, err := BreakerHalfOpen.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "half-open", string(txt))
+}
@@ -0,0 +1,217 @@
+package picker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+// maxCheckBody limits the size of response body read to match body expectations
+const maxCheckBody = 1024 * 1024
+
+// checkFunc checks health of the node with url made from node's server and ping, http checks made with client.
+// Should be aborted on ctx cancellation.
+type checkFunc func(ctx context.Context, rawURL string, node config.Node, client *http.Client, timeout time.Duration) error
+
+// checkers is a registry of check types by node's method. A new check type needs a checkFunc here
+// and the method allowed in config validation.
+var checkers = map[string]checkFunc{
+	"HEAD":           checkHTTP,
+	"GET":            checkHTTP,
+	config.MethodTCP: checkTCP,
+	config.MethodDNS: checkDNS,
+}
+
+// Check runs health check of the node once, the same way picker does. Canceled ctx aborts the check.
+func Check(ctx context.Context, node config.Node, timeout time.Duration) error {
+	client, _ := newHTTPClients(node)
+	return checkURL(ctx, node.Server+node.Ping, node, client, timeout)
+}
+
+// checkURL runs check registered for node's method, HEAD if method not defined
+func checkURL(ctx context.Context, rawURL string, node config.Node, client *http.Client, timeout time.Duration) error {
+	if node.Method == "" {
+		node.Method = "HEAD"
+	}
+	check, ok := checkers[node.Method]
+	if !ok {
+		return fmt.Errorf("refused to hit %s, unknown method %s", rawURL, node.Method)
+	}
+	return check(ctx, rawURL, node, client, timeout)
+}
+
+// checkHTTP hits url with method and headers of the node, using client with node's TLS options,
+// and verifies the response against node's expected status and body
+func checkHTTP(ctx context.Context, rawURL string, node config.Node, client *http.Client, timeout time.Duration) error {
+	method := node.Method
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("can't make request for %s: %w", rawURL, err)
+	}
+	for k, v := range node.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to hit %s, method %s: %w", rawURL, method, err)
+	}
+
+	defer func() {
+		if e := resp.Body.Close(); e != nil {
+			log.Printf("[WARN] failed to close response body, %v", e)
+		}
+	}()
+
+	if !node.ExpectStatus.Match(resp.StatusCode) {
+		return fmt.Errorf("bad status code %d for %s", resp.StatusCode, rawURL)
+	}
+
+	if method == "GET" && (node.ExpectBody != "" || node.ExpectBodyRe != "") {
+		return checkBody(rawURL, resp.Body, node)
+	}
+	return nil
+}
+
+// checkTCP only connects to node's host and port, port defined by scheme if not set in url
+func checkTCP(ctx context.Context, rawURL string, _ config.Node, _ *http.Client, timeout time.Duration) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("can't parse %s: %w", rawURL, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if err = conn.Close(); err != nil {
+		log.Printf("[WARN] failed to close connection to %s, %v", addr, err)
+	}
+	return nil
+}
+
+// checkDNS only resolves node's host
+func checkDNS(ctx context.Context, rawURL string, _ config.Node, _ *http.Client, timeout time.Duration) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("can't parse %s: %w", rawURL, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", u.Hostname(), err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no addresses for %s", u.Hostname())
+	}
+	return nil
+}
+
+// checkBody verifies response body contains expected substring and matches expected regex
+func checkBody(rawURL string, body io.Reader, node config.Node) error {
+	data, err := io.ReadAll(io.LimitReader(body, maxCheckBody))
+	if err != nil {
+		return fmt.Errorf("failed to read body of %s: %w", rawURL, err)
+	}
+	if node.ExpectBody != "" && !strings.Contains(string(data), node.ExpectBody) {
+		return fmt.Errorf("body of %s has no %q", rawURL, node.ExpectBody)
+	}
+	if node.ExpectBodyRe != "" {
+		re, err := regexp.Compile(node.ExpectBodyRe)
+		if err != nil {
+			return fmt.Errorf("invalid body regex %q: %w", node.ExpectBodyRe, err)
+		}
+		if !re.Match(data) {
+			return fmt.Errorf("body of %s doesn't match %q", rawURL, node.ExpectBodyRe)
+		}
+	}
+	return nil
+}
+
+// newHTTPClients makes clients with node's TLS options, sharing one transport: check client doesn't follow
+// redirects if expected status defined, so 3xx can be checked as is, and probe client always follows them.
+// Nodes without TLS options use default transport. Clients made once per node config and reused by all checks
+// and probes, timeouts set per request. Invalid TLS options reported by every request of the clients.
+func newHTTPClients(node config.Node) (check, probe *http.Client) {
+	var transport http.RoundTripper
+	if node.InsecureSkipVerify || node.CAFile != "" {
+		tlsConf, err := tlsConfig(node)
+		if err != nil {
+			transport = errTransport{err: err}
+		} else {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = tlsConf
+			transport = t
+		}
+	}
+
+	check, probe = &http.Client{Transport: transport}, &http.Client{Transport: transport}
+	if len(node.ExpectStatus) > 0 {
+		check.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	}
+	return check, probe
+}
+
+// tlsConfig makes TLS config with node's skip verify and CA file options
+func tlsConfig(node config.Node) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: node.InsecureSkipVerify, MinVersion: tls.VersionTLS12} // nolint:gosec // optional
+	if node.CAFile == "" {
+		return tlsConf, nil
+	}
+	data, err := os.ReadFile(node.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", node.CAFile)
+	}
+	tlsConf.RootCAs = pool
+	return tlsConf, nil
+}
+
+// errTransport fails every request with error of node's TLS options
+type errTransport struct {
+	err error
+}
+
+// RoundTrip returns transport's error
+func (t errTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// closeIdle closes idle connections of client's own transport, default transport shared with other clients kept
+func closeIdle(client *http.Client) {
+	if client != nil && client.Transport != nil {
+		client.CloseIdleConnections()
+	}
+}
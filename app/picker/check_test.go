@@ -0,0 +1,225 @@
+package picker
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+func TestCheckURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("request %+v", r)
+		if r.Method == "GET" && r.URL.Path == "/good_get" {
+			fmt.Fprintln(w, "good get")
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/slow_get" {
+			time.Sleep(1 * time.Second)
+			fmt.Fprintln(w, "slow get")
+			return
+		}
+		if r.Method == "HEAD" && r.URL.Path == "/good_head" {
+			fmt.Fprintln(w, "good head")
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	tbl := []struct {
+		url     string
+		method  string
+		isError bool
+	}{
+		{"/good_get", "GET", false},
+		{"/good_head", "HEAD", false},
+		{"/blah", "HEAD", true},
+		{"/blah", "GET", true},
+		{"/slow_get", "GET", true},
+		{"/good_get", "POST", true},
+	}
+
+	for i, tt := range tbl {
+		node := config.Node{Method: tt.method}
+		err := checkURL(context.Background(), ts.URL+tt.url, node, checkClient(node), time.Millisecond*500)
+		if tt.isError {
+			assert.NotNil(t, err, "check #%d", i)
+			continue
+		}
+		assert.NoError(t, err, "check #%d", i)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	assert.NoError(t, Check(context.Background(), config.Node{Server: ts.URL, Ping: "/ping", Method: "HEAD"}, time.Second))
+	assert.NoError(t, Check(context.Background(), config.Node{Server: ts.URL, Ping: "/ping", Method: "GET"}, time.Second))
+	assert.Error(t, Check(context.Background(), config.Node{Server: ts.URL, Ping: "/blah", Method: "GET"}, time.Second))
+}
+
+func TestCheckURL_Expectations(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprint(w, "all good, version 1.2.3")
+		case "/error-page":
+			fmt.Fprint(w, "<html>nginx error page</html>")
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/login-redirect":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case "/login":
+			fmt.Fprint(w, "login page")
+		case "/headers":
+			if r.Host != "mirror.example.com" || r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tbl := []struct {
+		name   string
+		path   string
+		node   config.Node
+		errMsg string
+	}{
+		{"default status", "/ok", config.Node{Method: "GET"}, ""},
+		{"default status, redirect followed", "/login-redirect", config.Node{Method: "GET"}, ""},
+		{"expected status", "/no-content", config.Node{Method: "HEAD", ExpectStatus: config.StatusList{{From: 204, To: 204}}}, ""},
+		{"unexpected status", "/ok", config.Node{Method: "HEAD", ExpectStatus: config.StatusList{{From: 204, To: 204}}},
+			"bad status code 200"},
+		{"status range", "/ok", config.Node{Method: "HEAD", ExpectStatus: config.StatusList{{From: 200, To: 299}}}, ""},
+		{"redirect not followed with expected status", "/login-redirect",
+			config.Node{Method: "GET", ExpectStatus: config.StatusList{{From: 200, To: 200}}}, "bad status code 302"},
+		{"redirect expected", "/login-redirect",
+			config.Node{Method: "GET", ExpectStatus: config.StatusList{{From: 200, To: 200}, {From: 302, To: 302}}}, ""},
+		{"body substring", "/ok", config.Node{Method: "GET", ExpectBody: "all good"}, ""},
+		{"body substring missing", "/error-page", config.Node{Method: "GET", ExpectBody: "all good"}, `has no "all good"`},
+		{"body regex", "/ok", config.Node{Method: "GET", ExpectBodyRe: `version \d+\.\d+\.\d+`}, ""},
+		{"body regex mismatch", "/error-page", config.Node{Method: "GET", ExpectBodyRe: `version \d+`}, "doesn't match"},
+		{"body ignored for HEAD", "/error-page", config.Node{Method: "HEAD", ExpectBody: "all good"}, ""},
+		{"headers", "/headers", config.Node{Method: "GET",
+			Headers: map[string]string{"Host": "mirror.example.com", "Authorization": "Bearer secret"}}, ""},
+		{"headers missing", "/headers", config.Node{Method: "GET"}, "bad status code 403"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkURL(context.Background(), ts.URL+tt.path, tt.node, checkClient(tt.node), time.Second)
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestCheckURL_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0o600))
+	badCAFile := filepath.Join(t.TempDir(), "bad.pem")
+	require.NoError(t, os.WriteFile(badCAFile, []byte("not a cert"), 0o600))
+
+	check := func(node config.Node) error {
+		return checkURL(context.Background(), ts.URL+"/ping", node, checkClient(node), time.Second)
+	}
+	err := check(config.Node{Method: "GET"})
+	require.Error(t, err, "self-signed cert rejected by default")
+	assert.Contains(t, err.Error(), "certificate")
+
+	assert.NoError(t, check(config.Node{Method: "GET", InsecureSkipVerify: true}))
+	assert.NoError(t, check(config.Node{Method: "GET", CAFile: caFile}))
+
+	err = check(config.Node{Method: "GET", CAFile: badCAFile})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no PEM certificates")
+
+	err = check(config.Node{Method: "GET", CAFile: "/no-such-file.pem"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't read CA file")
+}
+
+func TestCheckURL_TCP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError) // never called by tcp check
+	}))
+	defer ts.Close()
+
+	assert.NoError(t, Check(context.Background(), config.Node{Server: ts.URL, Ping: "/big.mp3", Method: "tcp"}, time.Second))
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+	err := Check(context.Background(), config.Node{Server: closedURL, Method: "tcp"}, time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to connect to 127.0.0.1:")
+}
+
+func TestCheckURL_DNS(t *testing.T) {
+	assert.NoError(t, Check(context.Background(), config.Node{Server: "http://localhost:12345", Method: "dns"}, time.Second))
+	assert.NoError(t, Check(context.Background(), config.Node{Server: "https://127.0.0.1", Method: "dns"}, time.Second))
+
+	err := Check(context.Background(), config.Node{Server: "http://no-such-host.invalid", Method: "dns"}, time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to resolve no-such-host.invalid")
+}
+
+func TestCheck_Canceled(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-hang
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	st := time.Now()
+	err := Check(ctx, config.Node{Server: ts.URL, Ping: "/ping", Method: "GET"}, time.Minute)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(st), time.Second)
+}
+
+func TestCheckURL_UnknownMethod(t *testing.T) {
+	err := checkURL(context.Background(), "http://localhost/ping", config.Node{Method: "POST"}, http.DefaultClient, time.Second)
+	assert.EqualError(t, err, "refused to hit http://localhost/ping, unknown method POST")
+}
+
+// checkClient returns check client of the node
+func checkClient(node config.Node) *http.Client {
+	client, _ := newHTTPClients(node)
+	return client
+}
@@ -0,0 +1,60 @@
+package picker
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Hash implements strategy with weighted consistent (rendezvous) hashing on resource path, query ignored,
+// so cache-busting and tracking params don't move the file to another node.
+// The same resource goes to the same node as long as the node is alive, and the share of each node
+// is proportional to its weight. If a node dies only resources of this node move to others, the rest stay in place.
+type Hash struct {
+	nodes []Node
+	lock  sync.RWMutex
+}
+
+// Update sets nodes to pick from
+func (h *Hash) Update(nodes []Node) {
+	h.lock.Lock()
+	h.nodes = nodes
+	h.lock.Unlock()
+}
+
+// Pick node with the highest weighted score of node's server and resource path
+func (h *Hash) Pick(resource string) (node Node, ok bool) {
+	path, _, _ := strings.Cut(resource, "?")
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	best := math.Inf(-1)
+	for _, n := range h.nodes {
+		if score := hashScore(n.Server, path, n.Weight); !ok || score > best {
+			node, best, ok = n, score, true
+		}
+	}
+	return node, ok
+}
+
+// hashScore makes weighted rendezvous score -weight/ln(u), where u is the hash of server and resource mapped to (0,1).
+// Probability for the node to get the highest score is weight/total.
+func hashScore(server, resource string, weight int) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(server))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(resource))
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53) // top 53 bits, never 0 or 1
+	return -float64(weight) / math.Log(u)
+}
+
+// mix64 is splitmix64 finalizer, fnv alone spreads poorly for keys different in the last bytes only
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,121 @@
+package picker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+func TestHash_Pick(t *testing.T) {
+	h := Hash{}
+	_, ok := h.Pick("/file.mp3")
+	assert.False(t, ok, "no nodes")
+
+	nodes := []Node{
+		{Node: config.Node{Server: "http://n1.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n2.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n3.example.com", Weight: 1}},
+	}
+	h.Update(nodes)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		resource := fmt.Sprintf("/rtfiles/rt_podcast%d.mp3", i)
+		node, ok := h.Pick(resource)
+		require.True(t, ok)
+		counts[node.Server]++
+		again, _ := h.Pick(resource)
+		assert.Equal(t, node.Server, again.Server, "same resource, same node")
+	}
+	t.Logf("%+v", counts)
+	for _, n := range nodes {
+		assert.InDelta(t, 1000, counts[n.Server], 150, n.Server)
+	}
+
+	for i := 0; i < 100; i++ {
+		resource := fmt.Sprintf("/rtfiles/rt_podcast%d.mp3", i)
+		node, _ := h.Pick(resource)
+		for _, query := range []string{"?ts=1", "?ts=2&utm_source=rss", "?"} {
+			withQuery, _ := h.Pick(resource + query)
+			assert.Equal(t, node.Server, withQuery.Server, "query ignored, %s%s", resource, query)
+		}
+	}
+}
+
+func TestHash_PickWeighted(t *testing.T) {
+	h := Hash{}
+	h.Update([]Node{
+		{Node: config.Node{Server: "http://n1.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n2.example.com", Weight: 3}},
+		{Node: config.Node{Server: "http://n3.example.com", Weight: 6}},
+	})
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		node, ok := h.Pick(fmt.Sprintf("/rtfiles/rt_podcast%d.mp3", i))
+		require.True(t, ok)
+		counts[node.Server]++
+	}
+	t.Logf("%+v", counts)
+	assert.InDelta(t, 1000, counts["http://n1.example.com"], 200)
+	assert.InDelta(t, 3000, counts["http://n2.example.com"], 300)
+	assert.InDelta(t, 6000, counts["http://n3.example.com"], 300)
+}
+
+func TestHash_Redistribution(t *testing.T) {
+	all := []Node{
+		{Node: config.Node{Server: "http://n1.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n2.example.com", Weight: 2}},
+		{Node: config.Node{Server: "http://n3.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n4.example.com", Weight: 1}},
+	}
+	const resources = 5000
+
+	assign := func(nodes []Node) map[string]string {
+		h := Hash{}
+		h.Update(nodes)
+		res := make(map[string]string, resources)
+		for i := 0; i < resources; i++ {
+			resource := fmt.Sprintf("/rtfiles/rt_podcast%d.mp3", i)
+			node, ok := h.Pick(resource)
+			require.True(t, ok)
+			res[resource] = node.Server
+		}
+		return res
+	}
+
+	before := assign(all)
+
+	// n2 died, only its resources moved
+	afterDeath := assign([]Node{all[0], all[2], all[3]})
+	moved := 0
+	for resource, server := range before {
+		if server == "http://n2.example.com" {
+			assert.NotEqual(t, "http://n2.example.com", afterDeath[resource])
+			moved++
+			continue
+		}
+		assert.Equal(t, server, afterDeath[resource], "resource %s moved from alive node", resource)
+	}
+	t.Logf("moved %d of %d", moved, resources)
+	assert.InDelta(t, resources*2/5, moved, resources/20, "moved n2 share only")
+
+	// n2 is back, all resources returned to the original nodes
+	assert.Equal(t, before, assign(all))
+
+	// new node n5 added, only resources picked by n5 moved and the rest stay
+	withNew := assign(append(append([]Node{}, all...), Node{Node: config.Node{Server: "http://n5.example.com", Weight: 1}}))
+	moved = 0
+	for resource, server := range before {
+		if withNew[resource] != server {
+			assert.Equal(t, "http://n5.example.com", withNew[resource])
+			moved++
+		}
+	}
+	t.Logf("moved to new node %d of %d", moved, resources)
+	assert.InDelta(t, resources/6, moved, resources/20, "new node took its share only")
+}
@@ -1,65 +1,526 @@
-// Package picker gets list of healthy nodes and pick one of them randomly based on weight
+// Package picker gets list of healthy nodes and pick one of them with the strategy defined for the service
 package picker
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/metrics"
 )
 
-// Node has a part from config and alive + changed for status monitoring
+// Node has a part from config and alive + changed for status monitoring.
+// successes and failures count consecutive checks, used to flip alive status with rise and fall thresholds.
 type Node struct {
 	config.Node
-	alive   bool
-	changed bool
+	alive     bool
+	changed   bool
+	checked   bool // at least one check done
+	successes int
+	failures  int
+
+	passiveFails  int       // consecutive failed failback probes of real requests
+	cooldownUntil time.Time // ejected node can't be marked alive till this time
+	breaker       breaker
+
+	client      *http.Client // health checks, made once per node config
+	probeClient *http.Client // failback probes, shares transport with client
 }
 
-// nodesFromConf makes picker Node from config
-func nodesFromConf(nodes config.NodesMap) (result map[string][]Node) {
-	result = map[string][]Node{}
-	for k, v := range nodes {
-		result[k] = []Node{}
-		for _, n := range v {
-			result[k] = append(result[k], Node{Node: n})
+// Alive returns current health status of the node
+func (n Node) Alive() bool { return n.alive }
+
+// Successes returns number of consecutive successful checks, 0 if the last check failed
+func (n Node) Successes() int { return n.successes }
+
+// Failures returns number of consecutive failed checks, 0 if the last check passed
+func (n Node) Failures() int { return n.failures }
+
+// CooldownUntil returns time the node ejected by passive checks can be back, zero if never ejected
+func (n Node) CooldownUntil() time.Time { return n.cooldownUntil }
+
+// Breaker returns state of node's circuit breaker and time open breaker allows trial requests
+func (n Node) Breaker() (state BreakerState, retryAt time.Time) {
+	state = n.breaker.current(time.Now())
+	if state == BreakerOpen {
+		retryAt = n.breaker.retryAt
+	}
+	return state, retryAt
+}
+
+// record check result and update alive status. The very first check sets the status right away,
+// after that alive node marked dead after Fall failures in a row and dead node marked alive after Rise successes.
+// Node in cooldown is not marked alive, but successes counted.
+func (n *Node) record(err error, now time.Time) {
+	prev := n.alive
+	if err == nil {
+		n.successes++
+		n.failures = 0
+		if (!n.checked || n.successes >= n.Rise) && !now.Before(n.cooldownUntil) {
+			n.alive = true
+		}
+	} else {
+		n.failures++
+		n.successes = 0
+		if !n.checked || n.failures >= n.Fall {
+			n.alive = false
 		}
 	}
-	return result
+	n.checked = true
+	n.changed = prev != n.alive
 }
 
-// checkURL with given method
-func checkURL(url, method string, timeout time.Duration) error {
+// recordPassive counts result of failback probe and ejects alive node after passive.Fails failures in a row.
+// Returns true if the node ejected.
+func (n *Node) recordPassive(err error, passive config.PassiveCheck, now time.Time) bool {
+	if err == nil {
+		n.passiveFails = 0
+		return false
+	}
+	n.passiveFails++
+	if passive.Fails == 0 || n.passiveFails < passive.Fails || !n.alive {
+		return false
+	}
+	n.passiveFails = 0
+	n.alive = false
+	n.successes = 0
+	n.cooldownUntil = now.Add(passive.Cooldown)
+	return true
+}
 
-	var resp *http.Response
-	var err error
+// Strategy selects a node of the service. Update called with alive nodes of non-zero weight
+// every time health status or nodes changed. Pick called for every request and should be thread-safe.
+type Strategy interface {
+	Update(nodes []Node)
+	Pick(resource string) (node Node, ok bool)
+}
+
+// Picker runs health checks for all nodes and picks alive node with the strategy defined for the service.
+// Each node checked independently, on its own interval and with its own timeout, refresh and timeout used as defaults.
+type Picker struct {
+	refresh     time.Duration
+	timeout     time.Duration
+	failBackURL string
+	nodes       map[string][]Node
+	strategies  map[string]Strategy
+	services    config.ServicesMap // service level params, like passive check and breaker
+	checks      map[nodeKey]context.CancelFunc
+
+	ctx    context.Context // canceled on Close, parent of all check loops
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // running check loops
+	lock   sync.RWMutex
+}
+
+// nodeKey identifies check loop of the node
+type nodeKey struct {
+	svc    string
+	server string
+}
+
+// New makes new picker. Activate health check loops for all nodes, running till ctx canceled or Close called
+func New(ctx context.Context, services config.ServicesMap, refresh, timeout time.Duration, failBackURL string) *Picker {
+	res := Picker{nodes: nodesFromConf(services), strategies: strategiesFromConf(services), services: services,
+		refresh: refresh, timeout: timeout, failBackURL: failBackURL, checks: map[nodeKey]context.CancelFunc{}}
+	res.ctx, res.cancel = context.WithCancel(ctx)
+	res.lock.Lock()
+	res.syncChecks()
+	res.lock.Unlock()
+	log.Printf("[DEBUG] services %+v", services)
+	return &res
+}
 
-	client := http.Client{Timeout: timeout}
-	switch method {
-	case "HEAD", "":
-		resp, err = client.Head(url)
-	case "GET":
-		resp, err = client.Get(url)
+// NewStrategy makes strategy by name, unknown and empty names fall back to random
+func NewStrategy(name string) Strategy {
+	switch name {
+	case config.StrategyRoundRobin:
+		return &RoundRobin{}
+	case config.StrategyHash:
+		return &Hash{}
+	case config.StrategyRandom, "":
+		return &RandomWeighted{}
 	default:
-		return fmt.Errorf("refused to hit %s, unknown method %s", url, method)
+		log.Printf("[WARN] unknown strategy %q, random used", name)
+		return &RandomWeighted{}
+	}
+}
+
+// Pick alive node for svc with service's strategy and make the final url for resource
+func (p *Picker) Pick(svc, resource string) (resURL string, node Node, err error) {
+	log.Printf("[DEBUG] pick %s for %s", svc, resource)
+
+	// node with half-open breaker removed from rotation as soon as its trial requests picked,
+	// so pick again if the node got the last trial request concurrently
+	for {
+		p.lock.RLock()
+		strategy, ok := p.strategies[svc]
+		p.lock.RUnlock()
+		if !ok {
+			return "", Node{}, fmt.Errorf("no node for %s", svc)
+		}
+		if node, ok = strategy.Pick(resource); !ok {
+			return "", Node{}, fmt.Errorf("no node for %s", svc)
+		}
+		if resURL, err = joinURL(node.Server, resource); err != nil {
+			return "", Node{}, err
+		}
+		if p.takeTrial(svc, node.Server) {
+			break
+		}
 	}
 
-	if err != nil {
-		return fmt.Errorf("failed to hit %s, method %s: %w", url, method, err)
+	p.lock.RLock()
+	failBackURL := p.failBackURL
+	p.lock.RUnlock()
+	if failBackURL != "" {
+		// probe is a part of the request, not of check loops, so it works after Close too
+		err = checkURL(context.Background(), resURL, config.Node{Method: "HEAD"}, node.probeClient, p.checkTimeout(node.Node))
+		p.recordProbe(svc, node.Server, err)
+		if err != nil {
+			if resURL, err = joinURL(failBackURL, resource); err != nil {
+				return "", Node{}, err
+			}
+			metrics.Failbacks.WithLabelValues(svc).Inc()
+		}
 	}
 
-	defer func() {
-		if e := resp.Body.Close(); e != nil {
-			log.Printf("[WARN] failed to close response body, %v", e)
+	return resURL, node, nil
+}
+
+// recordProbe counts failback probe result for passive check and breaker of the node.
+// Node ejected or with breaker opened removed from rotation right away, breaker's half-open state scheduled.
+func (p *Picker) recordProbe(svc, server string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	params := p.services[svc]
+	for i := range p.nodes[svc] {
+		n := &p.nodes[svc][i]
+		if n.Server != server {
+			continue
 		}
-	}()
+		now := time.Now()
+		ejected := n.recordPassive(err, params.Passive, now)
+		if ejected {
+			metrics.NodeAlive.WithLabelValues(svc, server).Set(0)
+			log.Printf("[INFO] %s [%s] ejected after %d failed probes, cooldown %v, %v",
+				server, svc, params.Passive.Fails, params.Passive.Cooldown, err)
+		}
+		breakerChanged := n.breaker.record(err, params.Breaker, now)
+		if breakerChanged {
+			state, retryAt := n.Breaker()
+			log.Printf("[INFO] breaker of %s [%s] %s", server, svc, state)
+			if state == BreakerOpen {
+				time.AfterFunc(retryAt.Sub(now), func() { p.refreshStrategy(svc) })
+			}
+		}
+		if ejected || breakerChanged {
+			p.strategies[svc].Update(pickable(p.nodes[svc]))
+		}
+		return
+	}
+}
+
+// takeTrial counts trial request to the node with half-open breaker, node removed from rotation
+// once its trials picked. Returns false if no trials left, true for node with breaker not half-open.
+// Breaker state checked under read lock first, so only requests to half-open nodes take the write lock.
+func (p *Picker) takeTrial(svc, server string) bool {
+	now := time.Now()
+	if !p.halfOpen(svc, server, now) {
+		return true
+	}
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("bad status code %d for %s", resp.StatusCode, url)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := range p.nodes[svc] {
+		n := &p.nodes[svc][i]
+		if n.Server != server {
+			continue
+		}
+		if !n.breaker.takeTrial(now) {
+			return false
+		}
+		if !n.breaker.pickable(now) {
+			p.strategies[svc].Update(pickable(p.nodes[svc]))
+		}
+		return true
 	}
+	return true
+}
 
-	return nil
+// halfOpen checks if the node has half-open breaker, always false for service with no breaker
+func (p *Picker) halfOpen(svc, server string, now time.Time) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.services[svc].Breaker.FailureRatio <= 0 {
+		return false
+	}
+	for i := range p.nodes[svc] {
+		if n := &p.nodes[svc][i]; n.Server == server {
+			return n.breaker.current(now) == BreakerHalfOpen
+		}
+	}
+	return false
+}
+
+// refreshStrategy updates service's strategy with currently pickable nodes, i.e. when breaker becomes half-open
+func (p *Picker) refreshStrategy(svc string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if strategy, ok := p.strategies[svc]; ok {
+		strategy.Update(pickable(p.nodes[svc]))
+	}
+}
+
+// Update replaces services and failback url in place, i.e. on config reload.
+// Nodes present in both old and new configs keep their alive status, check streaks and schedule,
+// new nodes checked right away and checks of removed nodes stopped. Http clients of all nodes made anew,
+// so changed TLS options and CA files applied, and idle connections of the old ones closed.
+func (p *Picker) Update(services config.ServicesMap, failBackURL string) {
+	updNodes := nodesFromConf(services)
+	strategies := strategiesFromConf(services)
+
+	p.lock.Lock()
+	for svc, svcNodes := range updNodes {
+		for i, n := range svcNodes {
+			for _, old := range p.nodes[svc] {
+				if old.Server == n.Server {
+					old.Node = n.Node
+					old.client, old.probeClient = n.client, n.probeClient
+					if failBackURL == "" || services[svc].Breaker.FailureRatio <= 0 {
+						old.breaker = breaker{} // no probes to drive the breaker without failback, or breaker disabled
+					}
+					updNodes[svc][i] = old
+					break
+				}
+			}
+		}
+		strategies[svc].Update(pickable(svcNodes))
+	}
+	for _, svcNodes := range p.nodes {
+		for _, n := range svcNodes {
+			closeIdle(n.client)
+		}
+	}
+	p.nodes = updNodes
+	p.strategies = strategies
+	p.services = services
+	p.failBackURL = failBackURL
+	p.syncChecks()
+	p.lock.Unlock()
+	log.Printf("[DEBUG] services updated %+v", services)
+}
+
+// Close stops all health checks, aborts checks in progress and waits for check loops to terminate.
+// Picker keeps serving Pick with the last known status of nodes.
+func (p *Picker) Close() {
+	p.cancel()
+	p.wg.Wait()
+	log.Printf("[DEBUG] picker closed")
+}
+
+// Nodes return copy of all current nodes
+func (p *Picker) Nodes() map[string][]Node {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	res := make(map[string][]Node, len(p.nodes))
+	for svc, nodes := range p.nodes {
+		res[svc] = make([]Node, len(nodes))
+		copy(res[svc], nodes)
+	}
+	return res
+}
+
+// Status return status of all nodes, true if all nodes are alive, false if at least one is dead and return list of dead nodes
+func (p *Picker) Status() (ok bool, failed []string) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, nodes := range p.nodes {
+		for _, node := range nodes {
+			if !node.alive {
+				failed = append(failed, node.Server)
+			}
+		}
+	}
+	return len(failed) == 0, failed
+}
+
+// syncChecks starts check loops for new nodes and stops loops of removed ones, should be called under lock.
+// Nothing started after picker closed.
+func (p *Picker) syncChecks() {
+	if p.ctx.Err() != nil {
+		return
+	}
+	active := map[nodeKey]bool{}
+	for svc, nodes := range p.nodes {
+		for _, n := range nodes {
+			key := nodeKey{svc: svc, server: n.Server}
+			active[key] = true
+			if _, ok := p.checks[key]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(p.ctx)
+			p.checks[key] = cancel
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.checkNode(ctx, key)
+			}()
+		}
+	}
+
+	for key, cancel := range p.checks {
+		if !active[key] {
+			cancel()
+			delete(p.checks, key)
+			metrics.DeleteNode(key.svc, key.server)
+		}
+	}
+}
+
+// checkNode runs periodic checks of a single node till ctx canceled.
+// Node's config re-read before every check, so interval and timeout changed on reload applied to the next check.
+func (p *Picker) checkNode(ctx context.Context, key nodeKey) {
+	log.Printf("[DEBUG] checks of %s [%s] started", key.server, key.svc)
+	for {
+		node, ok := p.node(key)
+		if !ok {
+			return
+		}
+		st := time.Now()
+		err := checkURL(ctx, node.Server+node.Ping, node.Node, node.client, p.checkTimeout(node.Node))
+		if ctx.Err() != nil {
+			log.Printf("[DEBUG] checks of %s [%s] stopped", key.server, key.svc)
+			return // aborted check is not a failure of the node
+		}
+		if err != nil {
+			log.Printf("[DEBUG] %v", err)
+		}
+		p.recordCheck(key, err, time.Since(st))
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[DEBUG] checks of %s [%s] stopped", key.server, key.svc)
+			return
+		case <-time.After(p.checkInterval(node.Node)):
+		}
+	}
+}
+
+// node returns current node for key
+func (p *Picker) node(key nodeKey) (Node, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, n := range p.nodes[key.svc] {
+		if n.Server == key.server {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// recordCheck applies check result to the node, node could be replaced by Update or ejected during the check.
+// Metrics recorded under the lock for nodes still present only, so series of removed nodes not recreated.
+func (p *Picker) recordCheck(key nodeKey, err error, duration time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	changed := 0
+	now := time.Now()
+	for i := range p.nodes[key.svc] {
+		n := &p.nodes[key.svc][i]
+		if n.Server != key.server {
+			continue
+		}
+		n.record(err, now)
+		metrics.Checks.WithLabelValues(key.svc, key.server, metrics.Result(err)).Inc()
+		metrics.CheckDuration.WithLabelValues(key.svc, key.server).Observe(duration.Seconds())
+		metrics.NodeAlive.WithLabelValues(key.svc, key.server).Set(aliveValue(n.alive))
+		if n.changed {
+			changed++
+			log.Printf("[INFO] changed status of %s [%s], %v -> %v", n.Server, key.svc, !n.alive, n.alive)
+			if err != nil {
+				log.Printf("[INFO] %v", err)
+			}
+		}
+	}
+	if changed == 0 {
+		return
+	}
+
+	p.strategies[key.svc].Update(pickable(p.nodes[key.svc]))
+	good, bad := getCounts(p.nodes[key.svc])
+	log.Printf("[INFO] %s alive counts updated, changed=%d {total:%d, passed:%d, failed:%d}",
+		key.svc, changed, good+bad, good, bad)
+}
+
+// checkTimeout returns node's check timeout, picker's timeout if not defined
+func (p *Picker) checkTimeout(n config.Node) time.Duration {
+	if n.Timeout > 0 {
+		return n.Timeout
+	}
+	return p.timeout
+}
+
+// checkInterval returns delay till the next check of the node, picker's refresh if not defined, plus random jitter
+func (p *Picker) checkInterval(n config.Node) time.Duration {
+	interval := p.refresh
+	if n.Interval > 0 {
+		interval = n.Interval
+	}
+	if n.Jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(n.Jitter))) // nolint
+	}
+	return interval
+}
+
+// nodesFromConf makes picker Node with its http clients from config
+func nodesFromConf(services config.ServicesMap) (result map[string][]Node) {
+	result = map[string][]Node{}
+	for k, v := range services {
+		result[k] = []Node{}
+		for _, n := range v.Nodes {
+			node := Node{Node: n}
+			node.client, node.probeClient = newHTTPClients(n)
+			result[k] = append(result[k], node)
+		}
+	}
+	return result
+}
+
+// strategiesFromConf makes strategy for each service
+func strategiesFromConf(services config.ServicesMap) map[string]Strategy {
+	result := make(map[string]Strategy, len(services))
+	for k, v := range services {
+		result[k] = NewStrategy(v.Strategy)
+	}
+	return result
+}
+
+// pickable returns alive nodes with non-zero weight and breaker letting requests through,
+// the only nodes strategies can pick from
+func pickable(nodes []Node) []Node {
+	now := time.Now()
+	res := make([]Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n.alive && n.Weight > 0 && n.breaker.pickable(now) {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// aliveValue converts alive status to gauge value
+func aliveValue(alive bool) float64 {
+	if alive {
+		return 1
+	}
+	return 0
 }
 
 func getCounts(nodes []Node) (good, bad int) {
@@ -1,54 +1,753 @@
 package picker
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/metrics"
 )
 
-func TestCheckURL(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func TestPicker_PickNoFailBack(t *testing.T) {
+
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Logf("request %+v", r)
-		if r.Method == "GET" && r.URL.Path == "/good_get" {
-			fmt.Fprintln(w, "good get")
+		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
+			fmt.Fprintln(w, "good get 1")
 			return
 		}
-		if r.Method == "GET" && r.URL.Path == "/slow_get" {
-			time.Sleep(1 * time.Second)
-			fmt.Fprintln(w, "slow get")
+		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
+			fmt.Fprintln(w, "good get 2")
 			return
 		}
-		if r.Method == "HEAD" && r.URL.Path == "/good_head" {
-			fmt.Fprintln(w, "good head")
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+
+	defer ts1.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("request %+v", r)
+		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
+			fmt.Fprintln(w, "good get 1")
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
+			fmt.Fprintln(w, "good get 2")
 			return
 		}
 		w.WriteHeader(http.StatusBadRequest)
 	}))
+	defer ts2.Close()
+
+	svcs := config.ServicesMap{
+		"test": {Nodes: []config.Node{
+			{Server: ts1.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
+			{Server: ts2.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
+		}},
+	}
+	rw := New(context.Background(), svcs, time.Second, time.Millisecond*100, "")
+	defer rw.Close()
+	time.Sleep(2 * time.Second)
+
+	r, _, err := rw.Pick("test", "/test/good_get1")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(r, ts1.URL) || strings.HasPrefix(r, ts2.URL))
+	assert.True(t, strings.HasSuffix(r, "/test/good_get1"))
+}
+
+func TestPicker_PickWithFailBack(t *testing.T) {
+
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("request %+v", r)
+		if r.Method == "HEAD" {
+			calls++
+			if calls > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
+			fmt.Fprintln(w, "good get 1")
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
+			fmt.Fprintln(w, "good get 2")
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	ts1 := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts1.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts2.Close()
+
+	svcs := config.ServicesMap{
+		"test": {Nodes: []config.Node{
+			{Server: ts1.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
+			{Server: ts2.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
+		}},
+	}
+	rw := New(context.Background(), svcs, time.Second, time.Millisecond*100, "http://archive.example.com/media")
+	defer rw.Close()
+	time.Sleep(2 * time.Second)
+
+	{
+		r, _, err := rw.Pick("test", "/test/good_get1")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(r, ts1.URL) || strings.HasPrefix(r, ts2.URL))
+		assert.True(t, strings.HasSuffix(r, "/test/good_get1"))
+	}
+
+	{
+		failbacks := testutil.ToFloat64(metrics.Failbacks.WithLabelValues("test"))
+		r, _, err := rw.Pick("test", "/test/good_get1")
+		assert.NoError(t, err)
+		assert.Equal(t, "http://archive.example.com/media/test/good_get1", r)
+		assert.Equal(t, failbacks+1, testutil.ToFloat64(metrics.Failbacks.WithLabelValues("test")))
+	}
+
+}
+
+func TestPicker_Update(t *testing.T) {
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts1.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts2.Close()
+
+	svcs := config.ServicesMap{
+		"upd": {Nodes: []config.Node{{Server: ts1.URL, Method: "HEAD", Ping: "/ping", Weight: 1}}},
+	}
+	rw := New(context.Background(), svcs, time.Minute, time.Millisecond*100, "")
+	defer rw.Close()
+	require.Eventually(t, func() bool { ok, _ := rw.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	rw.Update(config.ServicesMap{
+		"upd": {Nodes: []config.Node{
+			{Server: ts1.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 2},
+		}},
+		"upd2": {Strategy: "round-robin", Nodes: []config.Node{{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 1}}},
+	}, "http://archive.example.com")
+
+	nodes := rw.Nodes()
+	require.Len(t, nodes["upd"], 2)
+	assert.True(t, nodes["upd"][0].alive, "existing node keeps alive status")
+	assert.False(t, nodes["upd"][1].alive, "new node not checked yet")
+	assert.Equal(t, 2, nodes["upd"][1].Weight)
+
+	// new nodes checked right away, without waiting for refresh interval
+	require.Eventually(t, func() bool { ok, _ := rw.Status(); return ok }, time.Second, 10*time.Millisecond)
+	r, _, err := rw.Pick("upd2", "/file.mp3")
+	require.NoError(t, err)
+	assert.Equal(t, ts2.URL+"/file.mp3", r)
+
+	// removed service not served anymore
+	rw.Update(config.ServicesMap{"upd2": {Nodes: []config.Node{{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 1}}}}, "")
+	_, _, err = rw.Pick("upd", "/file.mp3")
+	assert.Error(t, err)
+	_, _, err = rw.Pick("upd2", "/file.mp3")
+	assert.NoError(t, err, "upd2 node kept alive")
+
+	// metrics of removed nodes deleted
+	for _, c := range []prometheus.Collector{metrics.NodeAlive, metrics.Checks, metrics.CheckDuration} {
+		assert.Zero(t, seriesOf(t, c, "upd"))
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.NodeAlive.WithLabelValues("upd2", ts2.URL)))
+}
+
+func TestPicker_IndependentChecks(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	var fastHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fastHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	svcs := config.ServicesMap{
+		"slow": {Nodes: []config.Node{
+			{Server: slow.URL, Method: "HEAD", Ping: "/ping", Weight: 1, Timeout: time.Second},
+			{Server: slow.URL + "/short", Method: "HEAD", Ping: "/ping", Weight: 1, Timeout: 50 * time.Millisecond},
+		}},
+		"fast": {Nodes: []config.Node{
+			{Server: fast.URL, Method: "HEAD", Ping: "/ping", Weight: 1, Interval: 10 * time.Millisecond, Jitter: 5 * time.Millisecond},
+		}},
+	}
+	p := New(context.Background(), svcs, time.Minute, 100*time.Millisecond, "")
+	defer p.Close()
+
+	// slow node checked with its own timeout, longer than global one
+	require.Eventually(t, func() bool { return p.Nodes()["slow"][0].Alive() }, time.Second, 10*time.Millisecond)
+	assert.True(t, fastHits.Load() >= 5, "fast node checked on its own interval while slow one in progress, %d", fastHits.Load())
+	assert.False(t, p.Nodes()["slow"][1].Alive(), "short node timeout")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.NodeAlive.WithLabelValues("slow", slow.URL)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.NodeAlive.WithLabelValues("slow", slow.URL+"/short")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Checks.WithLabelValues("slow", slow.URL+"/short", "failure")))
+	assert.True(t, testutil.ToFloat64(metrics.Checks.WithLabelValues("fast", fast.URL, "success")) >= 5)
+	duration := &dto.Metric{}
+	require.NoError(t, metrics.CheckDuration.WithLabelValues("fast", fast.URL).(prometheus.Metric).Write(duration))
+	assert.GreaterOrEqual(t, duration.GetHistogram().GetSampleCount(), uint64(5))
+
+	// removed node not checked anymore
+	p.Update(config.ServicesMap{"slow": svcs["slow"]}, "")
+	time.Sleep(30 * time.Millisecond)
+	hits := fastHits.Load()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, hits, fastHits.Load())
+}
+
+func TestPicker_Close(t *testing.T) {
+	var hits atomic.Int32
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if hits.Add(1) > 1 {
+			<-hang // the second check never completes by itself
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	svcs := config.ServicesMap{"test": {Nodes: []config.Node{
+		{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1, Interval: 10 * time.Millisecond},
+	}}}
+	p := New(context.Background(), svcs, time.Minute, time.Minute, "")
+	require.Eventually(t, func() bool { return hits.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("check in progress not aborted")
+	}
+
+	ok, _ := p.Status()
+	assert.True(t, ok, "aborted check doesn't fail the node")
+	p.Update(config.ServicesMap{"test": svcs["test"], "test2": svcs["test"]}, "")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), hits.Load(), "no checks after close")
+	r, _, err := p.Pick("test", "/file.mp3")
+	require.NoError(t, err, "closed picker still picks")
+	assert.Equal(t, ts.URL+"/file.mp3", r)
+}
+
+func TestPicker_ProbeAfterClose(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	svcs := config.ServicesMap{"test": {
+		Nodes:   []config.Node{{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1}},
+		Passive: config.PassiveCheck{Fails: 1, Cooldown: time.Minute},
+		Breaker: config.BreakerParams{FailureRatio: 0.5, MinRequests: 1, Window: time.Minute, OpenDuration: time.Minute},
+	}}
+	p := New(context.Background(), svcs, time.Minute, time.Second, "http://archive.example.com")
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+	p.Close()
+
+	for i := 0; i < 3; i++ {
+		r, _, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+		assert.Equal(t, ts.URL+"/file.mp3", r, "probed, not sent to failback")
+	}
+	node := p.Nodes()["test"][0]
+	assert.True(t, node.Alive(), "not ejected")
+	state, _ := node.Breaker()
+	assert.Equal(t, BreakerClosed, state)
+}
+
+func TestPicker_ContextCanceled(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svcs := config.ServicesMap{"test": {Nodes: []config.Node{
+		{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1, Interval: 10 * time.Millisecond},
+	}}}
+	p := New(ctx, svcs, time.Minute, time.Second, "")
+	require.Eventually(t, func() bool { return hits.Load() > 2 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	p.Close() // returns once all loops terminated
+	n := hits.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, hits.Load(), "no checks after context canceled")
+}
+
+func TestPicker_CheckInterval(t *testing.T) {
+	p := Picker{refresh: time.Minute, timeout: time.Second}
+	assert.Equal(t, time.Minute, p.checkInterval(config.Node{}))
+	assert.Equal(t, 5*time.Second, p.checkInterval(config.Node{Interval: 5 * time.Second}))
+	for i := 0; i < 100; i++ {
+		d := p.checkInterval(config.Node{Interval: 5 * time.Second, Jitter: time.Second})
+		assert.True(t, d >= 5*time.Second && d < 6*time.Second, "%v", d)
+	}
+
+	assert.Equal(t, time.Second, p.checkTimeout(config.Node{}))
+	assert.Equal(t, 15*time.Second, p.checkTimeout(config.Node{Timeout: 15 * time.Second}))
+}
+
+func TestNewStrategy(t *testing.T) {
+	assert.IsType(t, &RandomWeighted{}, NewStrategy(""))
+	assert.IsType(t, &RandomWeighted{}, NewStrategy("random"))
+	assert.IsType(t, &RoundRobin{}, NewStrategy("round-robin"))
+	assert.IsType(t, &Hash{}, NewStrategy("hash"))
+	assert.IsType(t, &RandomWeighted{}, NewStrategy("blah"))
+}
+
+func TestPicker_PickStrategy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
 	defer ts.Close()
+	ts2URL := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	svcs := config.ServicesMap{
+		"rr": {Strategy: "round-robin", Nodes: []config.Node{
+			{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts2URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts.URL + "/disabled", Method: "HEAD", Ping: "/ping", Weight: 0},
+		}},
+		"hash": {Strategy: "hash", Nodes: []config.Node{
+			{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts2URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+		}},
+	}
+	p := New(context.Background(), svcs, time.Minute, time.Second, "")
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	// round-robin alternates between nodes with non-zero weight
+	r1, _, err := p.Pick("rr", "/file.mp3")
+	require.NoError(t, err)
+	r2, _, err := p.Pick("rr", "/file.mp3")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{ts.URL + "/file.mp3", ts2URL + "/file.mp3"}, []string{r1, r2})
+
+	// hash keeps resource on the same node
+	r1, _, err = p.Pick("hash", "/file.mp3")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		r, _, err := p.Pick("hash", "/file.mp3")
+		require.NoError(t, err)
+		assert.Equal(t, r1, r)
+	}
+
+	_, _, err = p.Pick("blah", "/file.mp3")
+	assert.EqualError(t, err, "no node for blah")
+}
+
+func TestPicker_HashFlappingNode(t *testing.T) {
+	var down atomic.Bool
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts2.Close()
+	ts3 := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts3.Close()
+
+	svcs := config.ServicesMap{"hash": {Strategy: "hash", Nodes: []config.Node{
+		{Server: ts1.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+		{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+		{Server: ts3.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+	}}}
+	p := New(context.Background(), svcs, 20*time.Millisecond, time.Second, "")
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	assign := func() map[string]string {
+		res := map[string]string{}
+		for i := 0; i < 300; i++ {
+			resource := fmt.Sprintf("/file%d.mp3", i)
+			_, node, err := p.Pick("hash", resource)
+			require.NoError(t, err)
+			res[resource] = node.Server
+		}
+		return res
+	}
+	before := assign()
+
+	down.Store(true)
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return !ok }, time.Second, 10*time.Millisecond)
+	for resource, server := range assign() {
+		if before[resource] == ts1.URL {
+			assert.NotEqual(t, ts1.URL, server, "resource of the dead node moved")
+			continue
+		}
+		assert.Equal(t, before[resource], server, "resource of alive node stays")
+	}
+
+	down.Store(false)
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, before, assign(), "all resources back after node recovered")
+}
+
+func TestPicker_ReuseConnections(t *testing.T) {
+	var conns, reqs atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { reqs.Add(1) }))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	svcs := config.ServicesMap{"svc": {Nodes: []config.Node{
+		{Server: ts.URL, Method: "GET", Ping: "/ping", Weight: 1, InsecureSkipVerify: true},
+	}}}
+	p := New(context.Background(), svcs, 10*time.Millisecond, time.Second, ts.URL)
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 5*time.Millisecond)
+	for range 10 {
+		_, _, err := p.Pick("svc", "/file.mp3")
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a check and a probe can overlap and the transport can dial while a connection is being returned to the pool
+	assert.Less(t, conns.Load(), reqs.Load()/4, "checks and probes of the node reuse connections")
+
+	client := p.Nodes()["svc"][0].client
+	p.Update(svcs, ts.URL)
+	assert.NotSame(t, client, p.Nodes()["svc"][0].client, "client made anew on reload")
+}
+
+func TestNewHTTPClients(t *testing.T) {
+	check, probe := newHTTPClients(config.Node{Server: "http://n1.radio-t.com"})
+	assert.Nil(t, check.Transport, "default transport")
+	assert.Nil(t, check.CheckRedirect)
+	assert.Nil(t, probe.Transport)
+
+	check, probe = newHTTPClients(config.Node{Server: "https://n1.radio-t.com", InsecureSkipVerify: true,
+		ExpectStatus: config.StatusList{{From: 301, To: 301}}})
+	require.NotNil(t, check.Transport)
+	assert.Same(t, check.Transport, probe.Transport, "transport shared")
+	assert.NotNil(t, check.CheckRedirect, "redirects not followed by check with expected status")
+	assert.Nil(t, probe.CheckRedirect, "redirects followed by probe")
+}
+
+func TestNode_Record(t *testing.T) {
+	fail := fmt.Errorf("failed")
+	n := Node{Node: config.Node{Server: "http://n1.example.com", Rise: 2, Fall: 3}}
 
 	tbl := []struct {
-		url     string
-		method  string
-		isError bool
+		err       error
+		alive     bool
+		changed   bool
+		successes int
+		failures  int
+		comment   string
 	}{
-		{"/good_get", "GET", false},
-		{"/good_head", "HEAD", false},
-		{"/blah", "HEAD", true},
-		{"/blah", "GET", true},
-		{"/slow_get", "GET", true},
-		{"/good_get", "POST", true},
+		{nil, true, true, 1, 0, "first check sets status right away"},
+		{fail, true, false, 0, 1, "1st failure"},
+		{fail, true, false, 0, 2, "2nd failure"},
+		{nil, true, false, 1, 0, "success resets failures"},
+		{fail, true, false, 0, 1, "1st failure again"},
+		{fail, true, false, 0, 2, "2nd failure again"},
+		{fail, false, true, 0, 3, "3rd failure, marked dead"},
+		{fail, false, false, 0, 4, "still dead"},
+		{nil, false, false, 1, 0, "1st success"},
+		{nil, true, true, 2, 0, "2nd success, marked alive"},
+		{nil, true, false, 3, 0, "still alive"},
 	}
 
 	for i, tt := range tbl {
-		err := checkURL(ts.URL+tt.url, tt.method, time.Millisecond*500)
-		if tt.isError {
-			assert.NotNil(t, err, "check #%d", i)
-			continue
+		n.record(tt.err, time.Now())
+		assert.Equal(t, tt.alive, n.Alive(), "#%d %s", i, tt.comment)
+		assert.Equal(t, tt.changed, n.changed, "#%d %s", i, tt.comment)
+		assert.Equal(t, tt.successes, n.Successes(), "#%d %s", i, tt.comment)
+		assert.Equal(t, tt.failures, n.Failures(), "#%d %s", i, tt.comment)
+	}
+}
+
+func TestNode_RecordPassive(t *testing.T) {
+	fail := fmt.Errorf("failed")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	passive := config.PassiveCheck{Fails: 3, Cooldown: time.Minute}
+	n := Node{Node: config.Node{Server: "http://n1.example.com", Rise: 1, Fall: 1}}
+	n.record(nil, now)
+	require.True(t, n.Alive())
+
+	assert.False(t, n.recordPassive(fail, passive, now))
+	assert.False(t, n.recordPassive(fail, passive, now))
+	assert.False(t, n.recordPassive(nil, passive, now), "success resets failures")
+	assert.False(t, n.recordPassive(fail, passive, now))
+	assert.False(t, n.recordPassive(fail, passive, now))
+	assert.True(t, n.Alive())
+	assert.True(t, n.recordPassive(fail, passive, now), "3rd failure in a row ejects")
+	assert.False(t, n.Alive())
+	assert.Equal(t, now.Add(time.Minute), n.CooldownUntil())
+	assert.False(t, n.recordPassive(fail, passive, now), "dead node not ejected again")
+
+	n.record(nil, now.Add(30*time.Second))
+	assert.False(t, n.Alive(), "still in cooldown")
+	n.record(nil, now.Add(time.Minute))
+	assert.True(t, n.Alive(), "cooldown passed")
+
+	assert.False(t, n.recordPassive(fail, config.PassiveCheck{}, now), "disabled")
+	assert.True(t, n.Alive())
+}
+
+func TestPicker_PassiveEjection(t *testing.T) {
+	var resourceDown atomic.Bool
+	resourceDown.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.mp3" && resourceDown.Load() {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	svcs := config.ServicesMap{"test": {
+		Nodes:   []config.Node{{Server: ts.URL, Method: "HEAD", Ping: "/ping", Weight: 1}},
+		Passive: config.PassiveCheck{Fails: 2, Cooldown: 300 * time.Millisecond},
+	}}
+	p := New(context.Background(), svcs, 20*time.Millisecond, time.Second, "http://archive.example.com")
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		r, _, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+		assert.Equal(t, "http://archive.example.com/file.mp3", r, "rerouted to failback")
+	}
+
+	// ejected right away, regular checks pass but can't bring it back during cooldown
+	ok, failed := p.Status()
+	assert.False(t, ok)
+	assert.Equal(t, []string{ts.URL}, failed)
+	_, _, err := p.Pick("test", "/file.mp3")
+	assert.EqualError(t, err, "no node for test")
+	time.Sleep(100 * time.Millisecond)
+	ok, _ = p.Status()
+	assert.False(t, ok, "in cooldown")
+	assert.False(t, p.Nodes()["test"][0].CooldownUntil().IsZero())
+
+	resourceDown.Store(false)
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+	r, _, err := p.Pick("test", "/file.mp3")
+	require.NoError(t, err)
+	assert.Equal(t, ts.URL+"/file.mp3", r)
+}
+
+func TestPicker_Breaker(t *testing.T) {
+	var resourceDown atomic.Bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.mp3" && resourceDown.Load() {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	ts1 := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts2.Close()
+
+	svcs := config.ServicesMap{"test": {
+		Strategy: "round-robin",
+		Nodes: []config.Node{
+			{Server: ts1.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+		},
+		Breaker: config.BreakerParams{FailureRatio: 0.5, MinRequests: 2, Window: time.Minute,
+			OpenDuration: 200 * time.Millisecond, HalfOpenTrials: 1},
+	}}
+	p := New(context.Background(), svcs, time.Minute, time.Second, "http://archive.example.com")
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	breakerOf := func(server string) BreakerState {
+		for _, n := range p.Nodes()["test"] {
+			if n.Server == server {
+				state, _ := n.Breaker()
+				return state
+			}
+		}
+		return BreakerClosed
+	}
+
+	resourceDown.Store(true)
+	for i := 0; i < 4; i++ { // round-robin, 2 probes of each node
+		_, _, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, BreakerOpen, breakerOf(ts1.URL))
+	assert.Equal(t, BreakerClosed, breakerOf(ts2.URL))
+	_, retryAt := p.Nodes()["test"][0].Breaker()
+	assert.False(t, retryAt.IsZero())
+
+	// node with open breaker out of rotation, but still alive
+	for i := 0; i < 4; i++ {
+		r, _, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+		assert.Equal(t, ts2.URL+"/file.mp3", r)
+	}
+	ok, _ := p.Status()
+	assert.True(t, ok)
+
+	// half-open after open duration, successful trial closes the breaker
+	resourceDown.Store(false)
+	require.Eventually(t, func() bool { return breakerOf(ts1.URL) == BreakerHalfOpen }, time.Second, 10*time.Millisecond)
+	picked := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, node, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+		picked[node.Server] = true
+	}
+	assert.True(t, picked[ts1.URL], "back in rotation")
+	assert.Equal(t, BreakerClosed, breakerOf(ts1.URL))
+}
+
+func TestPicker_BreakerTrials(t *testing.T) {
+	var down atomic.Bool
+	var hits atomic.Int32
+	release := make(chan struct{})
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file.mp3" {
+			return
+		}
+		if down.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hits.Add(1)
+		<-release
+	}))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts2.Close()
+
+	svcs := config.ServicesMap{"test": {
+		Strategy: "round-robin",
+		Nodes: []config.Node{
+			{Server: ts1.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+			{Server: ts2.URL, Method: "HEAD", Ping: "/ping", Weight: 1},
+		},
+		Breaker: config.BreakerParams{FailureRatio: 0.5, MinRequests: 1, Window: time.Minute,
+			OpenDuration: 100 * time.Millisecond, HalfOpenTrials: 2},
+	}}
+	p := New(context.Background(), svcs, time.Minute, 5*time.Second, "http://archive.example.com")
+	defer p.Close()
+	require.Eventually(t, func() bool { ok, _ := p.Status(); return ok }, time.Second, 10*time.Millisecond)
+
+	down.Store(true)
+	for i := 0; i < 2; i++ {
+		_, _, err := p.Pick("test", "/file.mp3")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(0), hits.Load())
+	down.Store(false)
+	time.Sleep(150 * time.Millisecond) // half-open
+
+	// trial probes hang, so the node can't be closed while 20 requests picked concurrently
+	var wg sync.WaitGroup
+	var picked atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, node, err := p.Pick("test", "/file.mp3")
+			assert.NoError(t, err)
+			if node.Server == ts1.URL {
+				picked.Add(1)
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return hits.Load() == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), hits.Load(), "only trial requests sent to half-open node")
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), picked.Load())
+	state, _ := p.Nodes()["test"][0].Breaker()
+	assert.Equal(t, BreakerClosed, state, "closed by successful trials")
+}
+
+func TestPicker_PickNoWriteLock(t *testing.T) {
+	svcs := config.ServicesMap{
+		"plain": {Nodes: []config.Node{{Server: "http://n1.example.com", Weight: 1}}},
+		"breaker": {Nodes: []config.Node{{Server: "http://n2.example.com", Weight: 1}},
+			Breaker: config.BreakerParams{FailureRatio: 0.5, MinRequests: 1, Window: time.Minute, OpenDuration: time.Minute}},
+	}
+	p := New(context.Background(), svcs, time.Minute, time.Second, "")
+	p.Close()
+	p.lock.Lock()
+	for svc := range p.nodes {
+		p.nodes[svc][0].alive = true
+		p.strategies[svc].Update(pickable(p.nodes[svc]))
+	}
+	p.lock.Unlock()
+
+	// write lock can't be taken while read lock held, so Pick would block if it took one
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, svc := range []string{"plain", "breaker"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _, err := p.Pick(svc, "/file.mp3")
+			assert.NoError(t, err)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("pick of %s took write lock", svc)
+		}
+	}
+}
+
+// seriesOf counts series of the collector with service label svc
+func seriesOf(t *testing.T, c prometheus.Collector, svc string) (res int) {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		pb := &dto.Metric{}
+		require.NoError(t, m.Write(pb))
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "service" && l.GetValue() == svc {
+				res++
+			}
 		}
-		assert.NoError(t, err, "check #%d", i)
 	}
+	return res
 }
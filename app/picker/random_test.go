@@ -2,114 +2,87 @@ package picker
 
 import (
 	"fmt"
-	"net/http"
-	"net/http/httptest"
-	"strings"
+	"math/rand"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/rlb/app/config"
 )
 
-func TestRandom_PickNoFailBack(t *testing.T) {
-
-	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		t.Logf("request %+v", r)
-		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
-			fmt.Fprintln(w, "good get 1")
-			return
-		}
-		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
-			fmt.Fprintln(w, "good get 2")
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-	}))
+func TestRandomWeighted_Pick(t *testing.T) {
+	r := RandomWeighted{}
+	_, ok := r.Pick("/file.mp3")
+	assert.False(t, ok, "no nodes")
+
+	r.Update([]Node{
+		{Node: config.Node{Server: "http://n1.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n2.example.com", Weight: 3}},
+	})
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		node, ok := r.Pick("/file.mp3")
+		require.True(t, ok)
+		counts[node.Server]++
+	}
+	t.Logf("%+v", counts)
+	assert.InDelta(t, 2500, counts["http://n1.example.com"], 300)
+	assert.InDelta(t, 7500, counts["http://n2.example.com"], 300)
+}
 
-	defer ts1.Close()
+func TestRandomWeighted_PickZeroWeight(t *testing.T) {
+	r := RandomWeighted{}
+	r.Update([]Node{{Node: config.Node{Server: "http://n1.example.com", Weight: 0}}})
+	_, ok := r.Pick("/file.mp3")
+	assert.False(t, ok)
+
+	r.Update([]Node{
+		{Node: config.Node{Server: "http://n1.example.com", Weight: 0}},
+		{Node: config.Node{Server: "http://n2.example.com", Weight: 1}},
+		{Node: config.Node{Server: "http://n3.example.com", Weight: 0}},
+	})
+	for i := 0; i < 100; i++ {
+		node, ok := r.Pick("/file.mp3")
+		require.True(t, ok)
+		assert.Equal(t, "http://n2.example.com", node.Server)
+	}
+}
 
-	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		t.Logf("request %+v", r)
-		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
-			fmt.Fprintln(w, "good get 1")
-			return
-		}
-		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
-			fmt.Fprintln(w, "good get 2")
-			return
+func BenchmarkRandomWeighted_Pick(b *testing.B) {
+	r := RandomWeighted{}
+	r.Update(benchNodes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := r.Pick("/file.mp3"); !ok {
+			b.Fatal("no node")
 		}
-		w.WriteHeader(http.StatusBadRequest)
-	}))
-	defer ts2.Close()
-
-	nmap := map[string][]config.Node{
-		"test": {
-			{Server: ts1.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
-			{Server: ts2.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
-		},
 	}
-	rw := NewRandomWeighted(config.NodesMap(nmap), time.Second, time.Millisecond*100, "")
-	time.Sleep(2 * time.Second)
-
-	r, _, err := rw.Pick("test", "/test/good_get1")
-	assert.NoError(t, err)
-	assert.True(t, strings.HasPrefix(r, ts1.URL) || strings.HasPrefix(r, ts2.URL))
-	assert.True(t, strings.HasSuffix(r, "/test/good_get1"))
 }
 
-func TestRandom_PickWithFailBack(t *testing.T) {
-
-	calls := 0
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		t.Logf("request %+v", r)
-		if r.Method == "HEAD" {
-			calls++
-			if calls > 1 {
-				w.WriteHeader(http.StatusBadRequest)
-				return
+// BenchmarkRandomWeighted_PickExpand is a reference for the old selection, expanding nodes by weight on every pick
+func BenchmarkRandomWeighted_PickExpand(b *testing.B) {
+	nodes := benchNodes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alive := []Node{}
+		for _, node := range nodes {
+			for j := 0; j < node.Weight; j++ {
+				alive = append(alive, node)
 			}
-			w.WriteHeader(http.StatusOK)
-			return
 		}
-		if r.Method == "GET" && r.URL.Path == "/test/good_get1" {
-			fmt.Fprintln(w, "good get 1")
-			return
-		}
-		if r.Method == "GET" && r.URL.Path == "/test/good_get2" {
-			fmt.Fprintln(w, "good get 2")
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-	}
-
-	ts1 := httptest.NewServer(http.HandlerFunc(handler))
-	defer ts1.Close()
-
-	ts2 := httptest.NewServer(http.HandlerFunc(handler))
-	defer ts2.Close()
-
-	nmap := map[string][]config.Node{
-		"test": {
-			{Server: ts1.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
-			{Server: ts2.URL, Method: "GET", Ping: "/test/good_get1", Weight: 1},
-		},
-	}
-	rw := NewRandomWeighted(config.NodesMap(nmap), time.Second, time.Millisecond*100, "http://archive.example.com/media")
-	time.Sleep(2 * time.Second)
-
-	{
-		r, _, err := rw.Pick("test", "/test/good_get1")
-		assert.NoError(t, err)
-		assert.True(t, strings.HasPrefix(r, ts1.URL) || strings.HasPrefix(r, ts2.URL))
-		assert.True(t, strings.HasSuffix(r, "/test/good_get1"))
+		_ = alive[rand.Intn(len(alive))] // nolint
 	}
+}
 
-	{
-		r, _, err := rw.Pick("test", "/test/good_get1")
-		assert.NoError(t, err)
-		assert.Equal(t, "http://archive.example.com/media/test/good_get1", r)
+// benchNodes makes 10 nodes with weights in hundreds
+func benchNodes() []Node {
+	nodes := make([]Node, 0, 10)
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, Node{Node: config.Node{Server: fmt.Sprintf("http://n%d.example.com", i), Weight: 100 * (i + 1)}})
 	}
-
+	return nodes
 }
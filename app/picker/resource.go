@@ -0,0 +1,62 @@
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrBadResource returned for resource which can't be a path on the node
+var ErrBadResource = errors.New("bad resource")
+
+// NormalizeResource checks resource is an absolute path with optional query and normalizes it.
+// Scheme, host, user info, scheme-relative "//host", backslashes and control chars rejected, so a resource
+// can't turn the node's url into some other host. Dot segments resolved, path escaped and fragment dropped.
+func NormalizeResource(resource string) (string, error) {
+	if !strings.HasPrefix(resource, "/") || strings.HasPrefix(resource, "//") {
+		return "", fmt.Errorf("%w %q, should start with a single /", ErrBadResource, resource)
+	}
+	for _, c := range resource {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return "", fmt.Errorf("%w %q, control char or backslash", ErrBadResource, resource)
+		}
+	}
+	u, err := url.Parse(resource)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %w", ErrBadResource, resource, err)
+	}
+	if u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return "", fmt.Errorf("%w %q, not a path", ErrBadResource, resource)
+	}
+
+	cleaned := path.Clean(u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	res := url.URL{Path: cleaned, RawQuery: u.RawQuery}
+	return res.String(), nil
+}
+
+// joinURL makes url of resource on the server, server's scheme and host kept whatever the resource is.
+// Resource's path appended to server's path, resource's query used.
+func joinURL(server, resource string) (string, error) {
+	base, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("can't parse server %s: %w", server, err)
+	}
+	ref, err := url.Parse(resource)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %w", ErrBadResource, resource, err)
+	}
+	refPath, refRawPath := ref.Path, ref.EscapedPath()
+	if !strings.HasPrefix(refPath, "/") {
+		refPath, refRawPath = "/"+refPath, "/"+refRawPath
+	}
+
+	res := url.URL{Scheme: base.Scheme, Host: base.Host, User: base.User, RawQuery: ref.RawQuery,
+		Path:    strings.TrimSuffix(base.Path, "/") + refPath,
+		RawPath: strings.TrimSuffix(base.EscapedPath(), "/") + refRawPath}
+	return res.String(), nil
+}
@@ -0,0 +1,74 @@
+package picker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeResource(t *testing.T) {
+	tbl := []struct {
+		in, res string
+		fail    bool
+	}{
+		{in: "/rtfiles/rt_podcast480.mp3", res: "/rtfiles/rt_podcast480.mp3"},
+		{in: "/rtfiles/rt podcast.mp3", res: "/rtfiles/rt%20podcast.mp3"},
+		{in: "/rtfiles/rt%20podcast.mp3", res: "/rtfiles/rt%20podcast.mp3"},
+		{in: "/file.mp3?ts=123&x=y", res: "/file.mp3?ts=123&x=y"},
+		{in: "/file.mp3#frag", res: "/file.mp3"},
+		{in: "/a/./b/../c.mp3", res: "/a/c.mp3"},
+		{in: "/../../etc/passwd", res: "/etc/passwd"},
+		{in: "/a//b/", res: "/a/b/"},
+		{in: "/", res: "/"},
+		{in: "/@evil.com/x", res: "/@evil.com/x"},
+		{in: "", fail: true},
+		{in: "file.mp3", fail: true},
+		{in: "@evil.com/x", fail: true},
+		{in: ".evil.com/", fail: true},
+		{in: "//evil.com/x", fail: true},
+		{in: "http://evil.com/x", fail: true},
+		{in: "/\\evil.com/x", fail: true},
+		{in: "/file\r\nLocation: http://evil.com", fail: true},
+		{in: "/file%zz", fail: true},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			res, err := NormalizeResource(tt.in)
+			if tt.fail {
+				assert.ErrorIs(t, err, ErrBadResource)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tbl := []struct {
+		server, resource, res string
+	}{
+		{"http://n1.radio-t.com", "/file.mp3", "http://n1.radio-t.com/file.mp3"},
+		{"http://n1.radio-t.com/", "/file.mp3", "http://n1.radio-t.com/file.mp3"},
+		{"http://archive.radio-t.com/media", "/files/blah.mp3", "http://archive.radio-t.com/media/files/blah.mp3"},
+		{"https://n1.radio-t.com:8443", "/file.mp3?ts=1", "https://n1.radio-t.com:8443/file.mp3?ts=1"},
+		{"http://n1.radio-t.com", "/rt%20podcast.mp3", "http://n1.radio-t.com/rt%20podcast.mp3"},
+		{"http://n1.radio-t.com", "@evil.com/x", "http://n1.radio-t.com/@evil.com/x"},
+		{"http://n1.radio-t.com", ".evil.com/", "http://n1.radio-t.com/.evil.com/"},
+		{"http://n1.radio-t.com", "//evil.com/x", "http://n1.radio-t.com/x"},
+		{"http://n1.radio-t.com", "http://evil.com/x", "http://n1.radio-t.com/x"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.resource, func(t *testing.T) {
+			res, err := joinURL(tt.server, tt.resource)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+
+	_, err := joinURL("http://n1.radio-t.com", "/file%zz")
+	assert.ErrorIs(t, err, ErrBadResource)
+}
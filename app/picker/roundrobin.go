@@ -0,0 +1,41 @@
+package picker
+
+import "sync"
+
+// RoundRobin implements strategy with smooth weighted round-robin selection, the same as nginx does.
+// Spreads requests evenly, i.e. weights 5,1,1 give a,a,b,a,c,a,a instead of a,a,a,a,a,b,c
+type RoundRobin struct {
+	nodes   []Node
+	current []int // current weight of each node
+	lock    sync.Mutex
+}
+
+// Update sets nodes to pick from and resets selection state
+func (r *RoundRobin) Update(nodes []Node) {
+	r.lock.Lock()
+	r.nodes = nodes
+	r.current = make([]int, len(nodes))
+	r.lock.Unlock()
+}
+
+// Pick the next node. On each pick every node's current weight increased by its weight,
+// the node with the max current weight selected and decreased by the total weight.
+func (r *RoundRobin) Pick(string) (node Node, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	best, total := -1, 0
+	for i, n := range r.nodes {
+		r.current[i] += n.Weight
+		total += n.Weight
+		if best == -1 || r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return Node{}, false
+	}
+	r.current[best] -= total
+	return r.nodes[best], true
+}
@@ -0,0 +1,39 @@
+package picker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/config"
+)
+
+func TestRoundRobin_Pick(t *testing.T) {
+	r := RoundRobin{}
+	_, ok := r.Pick("/file.mp3")
+	assert.False(t, ok, "no nodes")
+
+	r.Update([]Node{
+		{Node: config.Node{Server: "a", Weight: 5}},
+		{Node: config.Node{Server: "b", Weight: 1}},
+		{Node: config.Node{Server: "c", Weight: 1}},
+	})
+
+	res := ""
+	for i := 0; i < 14; i++ {
+		node, ok := r.Pick("/file.mp3")
+		require.True(t, ok)
+		res += node.Server
+	}
+	assert.Equal(t, "aabacaaaabacaa", res, "smooth sequence repeated")
+
+	r.Update([]Node{{Node: config.Node{Server: "a", Weight: 1}}, {Node: config.Node{Server: "b", Weight: 1}}})
+	res = ""
+	for i := 0; i < 4; i++ {
+		node, ok := r.Pick("/file.mp3")
+		require.True(t, ok)
+		res += node.Server
+	}
+	assert.Equal(t, "abab", res)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostRoutes maps request's host to service, by exact host or by wildcard pattern of subdomains
+type hostRoutes struct {
+	exact     map[string]string
+	wildcards []wildcardHost // the longest suffix first, so the most specific pattern wins
+}
+
+// wildcardHost is *.example.com pattern, suffix is .example.com
+type wildcardHost struct {
+	suffix string
+	svc    string
+}
+
+// makeHostRoutes makes routes from host or *.domain pattern to service, hosts are case-insensitive
+func makeHostRoutes(hosts map[string]string) hostRoutes {
+	res := hostRoutes{exact: map[string]string{}}
+	for host, svc := range hosts {
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			res.wildcards = append(res.wildcards, wildcardHost{suffix: suffix, svc: svc})
+			continue
+		}
+		res.exact[host] = svc
+	}
+	sort.Slice(res.wildcards, func(i, j int) bool {
+		if len(res.wildcards[i].suffix) != len(res.wildcards[j].suffix) {
+			return len(res.wildcards[i].suffix) > len(res.wildcards[j].suffix)
+		}
+		return res.wildcards[i].suffix < res.wildcards[j].suffix
+	})
+	return res
+}
+
+// service returns service for host header, port and trailing dot ignored. Exact host preferred over wildcards,
+// wildcard matches subdomains of any level, but not the domain itself.
+func (h hostRoutes) service(hostHeader string) (svc string, ok bool) {
+	host := hostHeader
+	if hp, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = hp
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if svc, ok = h.exact[host]; ok {
+		return svc, true
+	}
+	for _, w := range h.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return w.svc, true
+		}
+	}
+	return "", false
+}
+
+// hostJump serves requests to hosts mapped to services as jumps, resource is the request's path with query,
+// i.e. http://media.example.com/rtfiles/x.mp3 is the same as /api/v1/jump/podcast/rtfiles/x.mp3 for
+// media.example.com mapped to podcast. Requests to other hosts passed through.
+func (s *RLBServer) hostJump(next http.Handler) http.Handler {
+	jump := s.bench.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.jump(w, r, r.PathValue("svc"), r.URL.RequestURI())
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.confLock.RLock()
+		svc, ok := s.hosts.service(r.Host)
+		s.confLock.RUnlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		r.SetPathValue("svc", svc)
+		jump.ServeHTTP(w, r)
+	})
+}
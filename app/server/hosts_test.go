@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostRoutes(t *testing.T) {
+	routes := makeHostRoutes(map[string]string{
+		"media.example.com":         "podcast",
+		"*.example.com":             "svc1",
+		"*.stream.example.com":      "radio",
+		"Stream.Example.com":        "stream",
+		"*.live.stream.example.com": "live",
+	})
+
+	tbl := []struct {
+		host, svc string
+		ok        bool
+	}{
+		{host: "media.example.com", svc: "podcast", ok: true},
+		{host: "MEDIA.example.com:8080", svc: "podcast", ok: true},
+		{host: "media.example.com.", svc: "podcast", ok: true},
+		{host: "stream.example.com", svc: "stream", ok: true},
+		{host: "a.stream.example.com", svc: "radio", ok: true},
+		{host: "a.b.stream.example.com", svc: "radio", ok: true},
+		{host: "x.live.stream.example.com", svc: "live", ok: true},
+		{host: "other.example.com", svc: "svc1", ok: true},
+		{host: "example.com", ok: false},
+		{host: "badexample.com", ok: false},
+		{host: "media.example.org", ok: false},
+		{host: "127.0.0.1:7070", ok: false},
+		{host: "", ok: false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.host, func(t *testing.T) {
+			svc, ok := routes.service(tt.host)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.svc, svc)
+		})
+	}
+}
+
+func TestHostJump(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1",
+		Hosts: map[string]string{"media.example.com": "svc1", "*.example.com": "svc2"}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, host, path string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	resp := do("GET", "media.example.com", "/rtfiles/x.mp3?ts=1")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://srv1.com/rtfiles/x.mp3?ts=1", resp.Header.Get("Location"))
+
+	resp = do("HEAD", "stream.example.com:443", "/api/v1/jump/svc1/x.mp3")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://srv1.com/api/v1/jump/svc1/x.mp3", resp.Header.Get("Location"), "whole path is resource")
+
+	resp = do("POST", "media.example.com", "/x.mp3")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp = do("GET", "media.example.com", "/ping")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "ping served for any host")
+
+	resp = do("GET", "localhost", "/api/v1/jump/svc1/x.mp3")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "other hosts routed by path")
+	assert.Equal(t, "http://srv2.com/x.mp3", resp.Header.Get("Location"))
+
+	srv.SetHosts(map[string]string{"stream.example.com": "svc1"})
+	resp = do("GET", "media.example.com", "/api/v1/status")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "media host not mapped after update")
+	resp = do("GET", "stream.example.com", "/x.mp3")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://srv1.com/x.mp3", resp.Header.Get("Location"))
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwarding headers, trusted only if set by a trusted proxy
+var forwardHeaders = []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"}
+
+// ParseTrustedProxies parses list of CIDRs, plain ip treated as a single address network
+func ParseTrustedProxies(vals []string) ([]netip.Prefix, error) {
+	res := make([]netip.Prefix, 0, len(vals))
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+			}
+			addr = addr.Unmap()
+			res = append(res, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		res = append(res, prefix.Masked())
+	}
+	return res, nil
+}
+
+// realIP sets request's RemoteAddr to the client address from forwarding headers if the peer is a trusted proxy.
+// Forwarding headers removed in any case, so neither handlers nor request logger can be fooled by headers
+// set by the client itself.
+func (s *RLBServer) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := clientAddr(r, s.trusted); ok {
+			port := "0"
+			if _, p, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				port = p
+			}
+			r.RemoteAddr = net.JoinHostPort(addr.String(), port)
+		}
+		for _, h := range forwardHeaders {
+			r.Header.Del(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientAddr returns client address from X-Forwarded-For, X-Real-IP or Forwarded headers, in this order.
+// Headers used only if the peer is trusted, and a chain of proxies walked from the right to the first untrusted address.
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	peer, ok := parseAddr(r.RemoteAddr)
+	if !ok || !isTrusted(peer, trusted) {
+		return netip.Addr{}, false
+	}
+
+	if addr, ok := lastUntrusted(splitList(r.Header.Values("X-Forwarded-For")), trusted); ok {
+		return addr, true
+	}
+	if addr, ok := parseAddr(r.Header.Get("X-Real-Ip")); ok {
+		return addr, true
+	}
+	var chain []string
+	for _, elem := range splitList(r.Header.Values("Forwarded")) {
+		for _, pair := range strings.Split(elem, ";") {
+			if k, v, found := strings.Cut(strings.TrimSpace(pair), "="); found && strings.EqualFold(k, "for") {
+				chain = append(chain, v)
+			}
+		}
+	}
+	return lastUntrusted(chain, trusted)
+}
+
+// lastUntrusted walks chain of addresses from the right and returns the first untrusted one,
+// or the leftmost one if all are trusted. Invalid address stops the walk, as nothing left to it can be trusted.
+func lastUntrusted(chain []string, trusted []netip.Prefix) (netip.Addr, bool) {
+	var res netip.Addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(chain[i])
+		if !ok {
+			break
+		}
+		res = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return res, res.IsValid()
+}
+
+// parseAddr parses ip with optional port, IPv6 in brackets and quotes allowed, i.e. "[2001:db8::1]:80"
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits comma separated values of all header lines
+func splitList(vals []string) []string {
+	var res []string
+	for _, v := range vals {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+	}
+	return res
+}
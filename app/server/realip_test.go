@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	res, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1 ", "", "2001:db8::/32", "::1", "10.1.2.3/16"})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"), netip.MustParsePrefix("::1/128"), netip.MustParsePrefix("10.1.0.0/16")}, res)
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies([]string{"bad"})
+	assert.Error(t, err)
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		res     string
+	}{
+		{name: "ipv4 direct", remote: "1.2.3.4:1234", res: "1.2.3.4:1234"},
+		{name: "ipv6 direct", remote: "[2001:db8::1]:1234", res: "[2001:db8::1]:1234"},
+		{name: "untrusted peer headers ignored", remote: "1.2.3.4:1234",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8", "X-Real-Ip": "5.6.7.8", "Forwarded": "for=5.6.7.8"},
+			res:     "1.2.3.4:1234"},
+		{name: "ipv6 untrusted peer headers ignored", remote: "[2001:db8::1]:1234",
+			headers: map[string]string{"X-Forwarded-For": "2001:db8::2"}, res: "[2001:db8::1]:1234"},
+		{name: "trusted no headers", remote: "10.0.0.1:1234", res: "10.0.0.1:1234"},
+		{name: "xff ipv4", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			res: "5.6.7.8:1234"},
+		{name: "xff chain, spoofed left part skipped", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}, res: "5.6.7.8:1234"},
+		{name: "xff all trusted", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, res: "10.0.0.3:1234"},
+		{name: "xff invalid stops the walk", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8, junk, 10.0.0.2"}, res: "10.0.0.2:1234"},
+		{name: "xff ipv6", remote: "[fd00::1]:1234", headers: map[string]string{"X-Forwarded-For": "2001:db8::1"},
+			res: "[2001:db8::1]:1234"},
+		{name: "xff ipv6 with port via ipv4 proxy", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "[2001:db8::1]:5555, fd00::2"}, res: "[2001:db8::1]:1234"},
+		{name: "xff ipv4 mapped", remote: "[::ffff:10.0.0.1]:1234", headers: map[string]string{"X-Forwarded-For": "::ffff:5.6.7.8"},
+			res: "5.6.7.8:1234"},
+		{name: "x-real-ip", remote: "10.0.0.1:1234", headers: map[string]string{"X-Real-Ip": "5.6.7.8"}, res: "5.6.7.8:1234"},
+		{name: "x-real-ip ipv6", remote: "[fd00::1]:1234", headers: map[string]string{"X-Real-Ip": "2001:db8::1"},
+			res: "[2001:db8::1]:1234"},
+		{name: "xff preferred over x-real-ip", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8", "X-Real-Ip": "6.6.6.6"}, res: "5.6.7.8:1234"},
+		{name: "forwarded", remote: "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=9.9.9.9;proto=https, For=5.6.7.8;by=10.0.0.1"}, res: "5.6.7.8:1234"},
+		{name: "forwarded ipv6", remote: "[fd00::1]:1234",
+			headers: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711", for=fd00::2`}, res: "[2001:db8:cafe::17]:1234"},
+		{name: "forwarded obfuscated", remote: "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=_hidden"}, res: "10.0.0.1:1234"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewRLBServer(newMockPicker(), Opts{TrustedProxies: trusted})
+			var remote string
+			var headers http.Header
+			h := srv.realIP(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				remote, headers = r.RemoteAddr, r.Header
+			}))
+			req := httptest.NewRequest("GET", "/svc?url=/f.mp3", http.NoBody)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tt.res, remote)
+			for _, k := range forwardHeaders {
+				assert.Empty(t, headers.Get(k), "forwarding headers removed")
+			}
+		})
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	for remote, res := range map[string]string{"1.2.3.4:80": "1.2.3.4", "[2001:db8::1]:80": "2001:db8::1", "1.2.3.4": "1.2.3.4"} {
+		req := httptest.NewRequest("GET", "/", http.NoBody)
+		req.RemoteAddr = remote
+		assert.Equal(t, res, remoteIP(req))
+	}
+}
+
+func TestRealIP_Stats(t *testing.T) {
+	sink := &mockSink{name: "mock"}
+	stats := NewStats(StatsParams{QueueSize: 10}, sink)
+	srv := NewRLBServer(newMockPicker(), Opts{Stats: stats, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, xff := range []string{"5.6.7.8", "2001:db8::1"} {
+		req, err := http.NewRequest("GET", ts.URL+"/svc1?url=/f.mp3", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", xff)
+		client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+	}
+	require.NoError(t, stats.Close(context.Background()))
+
+	var ips []string
+	for _, batch := range sink.batches {
+		for _, rec := range batch {
+			ips = append(ips, rec.FromIP)
+		}
+	}
+	assert.Equal(t, []string{"5.6.7.8", "2001:db8::1"}, ips)
+}
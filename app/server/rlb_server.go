@@ -2,14 +2,17 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -17,19 +20,30 @@ import (
 	"github.com/go-pkgz/rest/logger"
 	"github.com/go-pkgz/routegroup"
 	"github.com/lithammer/shortuuid/v4"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/metrics"
 	"github.com/umputun/rlb/app/picker"
+	"github.com/umputun/rlb/app/sign"
 )
 
 // RLBServer - main rlb server
 type RLBServer struct {
 	nodePicker Picker
-	statsURL   string
+	stats      *Stats      // nil if stats disabled
+	store      *StatsStore // nil if stats store disabled
+	trusted    []netip.Prefix
 	errMsg     string
+	services   map[string]service
+	hosts      hostRoutes
 	version    string
 	port       int
 	bench      *rest.Benchmarks
 	httpServer *http.Server
 	lock       sync.Mutex
+	confLock   sync.RWMutex // protects errMsg, services and hosts, replaced on config reload
+
+	draining atomic.Bool // set on shutdown, ping and status report not-ready
 }
 
 // Picker defines pick method to return final redirect url from service and resource
@@ -48,16 +62,35 @@ type LogRecord struct {
 	Service  string    `json:"service"`
 	DestHost string    `json:"dest"`
 	Referer  string    `json:"referer"`
+
+	RefererDenied bool `json:"referer_denied,omitempty"` // request denied by referer check, not redirected
+}
+
+// Opts defines params of rlb server
+type Opts struct {
+	Port          int
+	Version       string
+	NoNodeMessage string             // response body if no alive node found
+	Services      config.ServicesMap // redirect params and allowed paths of services, defaults for services not defined
+	Hosts         map[string]string  // host or *.domain pattern to service, requests to these hosts are jumps
+	Stats         *Stats             // stats submitter, optional
+	Store         *StatsStore        // serves stats API, optional. Should be one of stats sinks to get records
+
+	TrustedProxies []netip.Prefix // peers allowed to pass client ip in forwarding headers
 }
 
 // NewRLBServer makes a new rlb server for map of services
-func NewRLBServer(nodePicker Picker, emsg, statsURL string, port int, version string) *RLBServer {
+func NewRLBServer(nodePicker Picker, opts Opts) *RLBServer {
 	res := RLBServer{
 		nodePicker: nodePicker,
-		errMsg:     emsg,
-		statsURL:   statsURL,
-		version:    version,
-		port:       port,
+		errMsg:     opts.NoNodeMessage,
+		services:   makeServices(opts.Services),
+		hosts:      makeHostRoutes(opts.Hosts),
+		stats:      opts.Stats,
+		store:      opts.Store,
+		trusted:    opts.TrustedProxies,
+		version:    opts.Version,
+		port:       opts.Port,
 		bench:      rest.NewBenchmarks(),
 	}
 	for k, v := range nodePicker.Nodes() {
@@ -66,6 +99,27 @@ func NewRLBServer(nodePicker Picker, emsg, statsURL string, port int, version st
 	return &res
 }
 
+// SetNoNodeMessage replaces message returned when no alive node found, i.e. on config reload
+func (s *RLBServer) SetNoNodeMessage(emsg string) {
+	s.confLock.Lock()
+	s.errMsg = emsg
+	s.confLock.Unlock()
+}
+
+// SetServices replaces services with their redirect params and allowed paths, i.e. on config reload
+func (s *RLBServer) SetServices(services config.ServicesMap) {
+	s.confLock.Lock()
+	s.services = makeServices(services)
+	s.confLock.Unlock()
+}
+
+// SetHosts replaces hosts mapped to services, i.e. on config reload
+func (s *RLBServer) SetHosts(hosts map[string]string) {
+	s.confLock.Lock()
+	s.hosts = makeHostRoutes(hosts)
+	s.confLock.Unlock()
+}
+
 // Run activates alive updater and web server
 func (s *RLBServer) Run() {
 	log.Printf("[INFO] activate web server on port %d", s.port)
@@ -82,40 +136,61 @@ func (s *RLBServer) Run() {
 	s.lock.Unlock()
 
 	err := s.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Print("[INFO] http server stopped accepting connections")
+		return
+	}
 	log.Printf("[WARN] http server terminated, %s", err)
 }
 
-// Shutdown rlb http server
-func (s *RLBServer) Shutdown() {
-	log.Print("[WARN] shutdown rest server")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// Shutdown rlb http server gracefully. Server reports not-ready on ping and status for drain period first,
+// so upstream proxy stops sending traffic, and still serves requests. After that it stops accepting connections
+// and waits for in-flight requests and stats submissions, up to timeout.
+func (s *RLBServer) Shutdown(drain, timeout time.Duration) {
+	log.Printf("[INFO] shutdown rest server, drain=%v, timeout=%v", drain, timeout)
+	s.draining.Store(true)
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	s.lock.Lock()
 	if s.httpServer != nil {
 		if err := s.httpServer.Shutdown(ctx); err != nil {
-			log.Printf("[DEBUG] http shutdown error, %s", err)
+			log.Printf("[WARN] http shutdown error, %s", err)
 		}
 		log.Print("[DEBUG] shutdown http server completed")
 	}
 	s.lock.Unlock()
+
+	if s.stats == nil {
+		return
+	}
+	if err := s.stats.Close(ctx); err != nil {
+		log.Printf("[WARN] %v", err)
+		return
+	}
+	log.Print("[DEBUG] stats submissions completed")
 }
 
 func (s *RLBServer) routes() http.Handler {
 	router := routegroup.New(http.NewServeMux())
 
-	router.Use(rest.Recoverer(log.Default()))
+	router.Use(rest.Recoverer(log.Default()), s.realIP)
 	router.Use(rest.Throttle(10000))
-	router.Use(rest.AppInfo("RLB", "Umputun", s.version), rest.Ping)
+	router.Use(rest.AppInfo("RLB", "Umputun", s.version), s.ping)
 	router.Use(rest.NoCache)
+	router.Use(metrics.Middleware("/metrics"))
 
 	router.Use(logger.New(logger.Log(log.Default()), logger.WithBody, logger.Prefix("[DEBUG]"),
 		logger.IPfn(logger.AnonymizeIP)).Handler)
+	router.Use(s.hostJump)
 
 	// current routes
 	router.Mount("/api/v1/jump").Route(func(r *routegroup.Bundle) {
 		r.Use(s.bench.Handler)
 		r.HandleFunc("GET /{svc}", s.DoJump)
 		r.HandleFunc("HEAD /{svc}", s.DoJump)
+		r.HandleFunc("GET /{svc}/{path...}", s.DoJump) // serves HEAD too
 	})
 
 	// legacy routes
@@ -123,91 +198,192 @@ func (s *RLBServer) routes() http.Handler {
 		r.Use(s.bench.Handler)
 		r.HandleFunc("GET /{svc}", s.DoJump)
 		r.HandleFunc("HEAD /{svc}", s.DoJump)
+		r.HandleFunc("GET /{svc}/{path...}", s.DoJump) // serves HEAD too
 	})
 
 	router.HandleFunc("GET /api/v1/status", s.statusCtrl)
 	router.HandleFunc("GET /api/v1/bench", s.benchCtrl)
+	if s.store != nil {
+		router.HandleFunc("GET /api/v1/stats/top", s.statsTopCtrl)
+		router.HandleFunc("GET /api/v1/stats/timeline", s.statsTimelineCtrl)
+	}
 
 	return router
 }
 
-// DoJump - jump to alive server for svc, url = Query("url")
+// DoJump - jump to alive server for svc, url = Query("url"), or the path after svc with request's query,
+// i.e. /api/v1/jump/svc/file.mp3?ts=1 is the same as /api/v1/jump/svc?url=/file.mp3?ts=1.
 func (s *RLBServer) DoJump(w http.ResponseWriter, r *http.Request) {
-	svc := r.PathValue("svc")
-	url := r.URL.Query().Get("url")
-	log.Printf("[DEBUG] jump %s %s", svc, url)
-	redirURL, node, err := s.nodePicker.Pick(svc, url)
+	resource := r.URL.Query().Get("url")
+	if path := r.PathValue("path"); path != "" {
+		resource = (&url.URL{Path: "/" + path, RawQuery: r.URL.RawQuery}).String()
+	}
+	s.jump(w, r, r.PathValue("svc"), resource)
+}
+
+// jump redirects to alive server of svc for resource. Resource normalized and checked against
+// service's allowed paths, rejected with 400. Signed service requires valid link signature, rejected with 403,
+// and redirect url gets nginx secure_link token if node secret defined. Request with referer not allowed
+// gets service's referer_denied response.
+func (s *RLBServer) jump(w http.ResponseWriter, r *http.Request, svc, resource string) {
+	s.confLock.RLock()
+	service, known := s.services[svc]
+	s.confLock.RUnlock()
+
+	if service.Sign.Secret != "" {
+		resource = sign.Strip(resource)
+	}
+	resource, err := picker.NormalizeResource(resource)
+	if err == nil && !service.allowed(resource) {
+		err = fmt.Errorf("%w %q, not allowed for %s", picker.ErrBadResource, resource, svc)
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = w.Write([]byte(s.errMsg))
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "invalid resource")
+		return
+	}
+	if err = service.verify(r, svc, resource); err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusForbidden, err, "invalid signature")
+		return
+	}
+
+	if !s.checkReferer(w, r, service, svc, resource) {
 		return
 	}
 
-	log.Printf("[DEBUG] redirect to %s%s", node.Server, url)
-	go func() {
-		if err := s.submitStats(r, node, svc+url); err != nil {
-			log.Printf("[DEBUG] can't submit stats, %s", err)
+	log.Printf("[DEBUG] jump %s %s", svc, resource)
+	redirURL, node, err := s.nodePicker.Pick(svc, resource)
+	if err != nil {
+		s.confLock.RLock()
+		emsg := s.errMsg
+		s.confLock.RUnlock()
+		label := svc
+		if !known {
+			label = metrics.UnknownService // svc comes from request, only configured services are labels
 		}
-	}()
+		metrics.NoNode.WithLabelValues(label).Inc()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(emsg))
+		return
+	}
 
-	http.Redirect(w, r, redirURL, http.StatusFound)
+	log.Printf("[DEBUG] redirect to %s%s", node.Server, resource)
+	metrics.Redirects.WithLabelValues(svc, node.Server).Inc()
+	if s.stats != nil && !s.stats.Submit(makeLogRecord(r, node, svc+resource)) {
+		log.Printf("[DEBUG] stats record for %s%s dropped", svc, resource)
+	}
+	if redirURL, err = service.addNodeToken(r, redirURL); err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't make node token")
+		return
+	}
+	service.redirect(w, r, redirURL)
 }
 
-func (s *RLBServer) submitStats(r *http.Request, node picker.Node, url string) error {
-	if s.statsURL == "" {
-		return nil
+// checkReferer checks referer of request to resource of svc, if the service has allowed referers.
+// Denied request gets service's response, counted in metrics and reported to stats without dest.
+func (s *RLBServer) checkReferer(w http.ResponseWriter, r *http.Request, service service, svc, resource string) bool {
+	if len(service.AllowedReferers) == 0 {
+		return true
+	}
+	if service.refererAllowed(r) {
+		metrics.RefererChecks.WithLabelValues(svc, metrics.ResultAllowed).Inc()
+		return true
+	}
+
+	log.Printf("[DEBUG] referer %q not allowed for %s%s", r.Referer(), svc, resource)
+	metrics.RefererChecks.WithLabelValues(svc, metrics.ResultDenied).Inc()
+	rec := makeLogRecord(r, picker.Node{}, svc+resource)
+	rec.RefererDenied = true
+	if s.stats != nil && !s.stats.Submit(rec) {
+		log.Printf("[DEBUG] stats record for %s%s dropped", svc, resource)
 	}
+	service.denyReferer(w, r)
+	return false
+}
 
+// ping middleware responds to GET/HEAD /ping with pong, or with 503 while draining.
+// Unlike rest.Ping it matches the exact path only, so a service named "ping" can't be shadowed.
+func (s *RLBServer) ping(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.URL.Path != "/ping" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if s.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("pong"))
+	})
+}
+
+// makeLogRecord makes stats record for redirect of request to node, url is service + resource.
+// Resource's query is not a part of file name.
+func makeLogRecord(r *http.Request, node picker.Node, url string) LogRecord {
+	url, _, _ = strings.Cut(url, "?")
 	fileNameSplit := strings.Split(strings.TrimLeft(url, "/"), "/")
-	lrec := LogRecord{
+	return LogRecord{
 		ID:       shortuuid.New(),
-		FromIP:   strings.Split(r.RemoteAddr, ":")[0],
+		FromIP:   remoteIP(r),
 		TS:       time.Now(),
 		FileName: strings.Join(fileNameSplit[1:], "/"),
 		Service:  fileNameSplit[0],
 		DestHost: strings.TrimPrefix(strings.TrimPrefix(node.Server, "http://"), "https://"),
 		Referer:  r.Referer(),
 	}
-	client := http.Client{Timeout: time.Millisecond * 100}
-
-	data, err := json.Marshal(&lrec)
-	if err != nil {
-		return fmt.Errorf("can't marshal: %w", err)
-	}
+}
 
-	resp, err := client.Post(s.statsURL, "application/json", bytes.NewReader(data))
+// remoteIP returns ip of request's RemoteAddr, the client address if the request came via trusted proxy
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return fmt.Errorf("remote call failed: %w", err)
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	defer func() {
-		if e := resp.Body.Close(); e != nil {
-			log.Printf("[WARN] failed to close response body, %v", e)
-		}
-	}()
+// GET /api/v1/status - returns status of all nodes, 200, 417 failed, 503 draining on shutdown.
+// Includes per-service details with consecutive check results, so one can see a node about to flip.
+func (s *RLBServer) statusCtrl(w http.ResponseWriter, _ *http.Request) {
+	type nodeStatus struct {
+		Server    string `json:"server"`
+		Alive     bool   `json:"alive"`
+		Successes int    `json:"successes"`
+		Failures  int    `json:"failures"`
+		Rise      int    `json:"rise"`
+		Fall      int    `json:"fall"`
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("[WARN] failed to read response body, %v", err)
+		CooldownUntil time.Time           `json:"cooldown_until,omitzero"`
+		Breaker       picker.BreakerState `json:"breaker"`
+		RetryAt       time.Time           `json:"retry_at,omitzero"` // open breaker allows trial requests at this time
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code %d, body %s", resp.StatusCode, string(body))
+	services := map[string][]nodeStatus{}
+	for svc, nodes := range s.nodePicker.Nodes() {
+		services[svc] = make([]nodeStatus, 0, len(nodes))
+		for _, n := range nodes {
+			breaker, retryAt := n.Breaker()
+			services[svc] = append(services[svc], nodeStatus{Server: n.Server, Alive: n.Alive(),
+				Successes: n.Successes(), Failures: n.Failures(), Rise: n.Rise, Fall: n.Fall,
+				CooldownUntil: n.CooldownUntil(), Breaker: breaker, RetryAt: retryAt})
+		}
 	}
 
-	return nil
-}
-
-// GET /api/v1/status - returns status of all nodes, 200, 417 failed
-func (s *RLBServer) statusCtrl(w http.ResponseWriter, _ *http.Request) {
 	ok, failed := s.nodePicker.Status()
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		rest.RenderJSON(w, rest.JSON{"status": "draining", "hosts": failed, "services": services})
+		return
+	}
 	if !ok {
 		w.WriteHeader(http.StatusExpectationFailed)
-		rest.RenderJSON(w, rest.JSON{"status": "failed", "hosts": failed})
+		rest.RenderJSON(w, rest.JSON{"status": "failed", "hosts": failed, "services": services})
 		return
 	}
-	rest.RenderJSON(w, rest.JSON{"status": "ok"})
+	rest.RenderJSON(w, rest.JSON{"status": "ok", "services": services})
 }
 
 // GET /api/v1/bench - returns benchmarks json for 1, 5 and 15 minutes ranges
@@ -224,3 +400,53 @@ func (s *RLBServer) benchCtrl(w http.ResponseWriter, _ *http.Request) {
 
 	rest.RenderJSON(w, resp)
 }
+
+// GET /api/v1/stats/top?svc=podcast&period=24h&by=file&limit=10 - returns items with the most downloads
+// for the period, grouped by file (default), node or service. All services counted if svc not set.
+func (s *RLBServer) statsTopCtrl(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period, err := ParsePeriod(queryOr(q.Get("period"), "24h"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "invalid period")
+		return
+	}
+	limit, err := strconv.Atoi(queryOr(q.Get("limit"), "10"))
+	if err != nil || limit < 0 {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, fmt.Errorf("invalid limit %q", q.Get("limit")), "invalid limit")
+		return
+	}
+
+	svc, by := q.Get("svc"), queryOr(q.Get("by"), TopByFile)
+	items, err := s.store.Top(svc, by, period, limit)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't get top")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"svc": svc, "by": by, "period": period.String(), "items": items})
+}
+
+// GET /api/v1/stats/timeline?svc=podcast&file=rt_podcast900.mp3&period=24h - returns downloads per time bucket
+// for the period. All services counted if svc not set, all files if file not set.
+func (s *RLBServer) statsTimelineCtrl(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period, err := ParsePeriod(queryOr(q.Get("period"), "24h"))
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "invalid period")
+		return
+	}
+
+	svc, file := q.Get("svc"), q.Get("file")
+	points, err := s.store.Timeline(svc, file, period)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't get timeline")
+		return
+	}
+	rest.RenderJSON(w, rest.JSON{"svc": svc, "file": file, "period": period.String(), "points": points})
+}
+
+func queryOr(val, def string) string {
+	if val == "" {
+		return def
+	}
+	return val
+}
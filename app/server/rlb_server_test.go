@@ -1,28 +1,35 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/metrics"
 	"github.com/umputun/rlb/app/picker"
+	"github.com/umputun/rlb/app/sign"
 )
 
 func TestDoJump(t *testing.T) {
 
-	srv := NewRLBServer(newMockPicker(), "error msg", "", 0, "v1")
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1"})
 	ts := httptest.NewServer(srv.routes())
 	defer ts.Close()
-	defer srv.Shutdown()
+	defer srv.Shutdown(0, time.Second)
 
 	r, err := hit(hitReq{"svc1", "/file123.mp3", ts.URL})
 	assert.NoError(t, err)
@@ -37,15 +44,259 @@ func TestDoJump(t *testing.T) {
 	assert.Equal(t, "http://srv1.com/file12345.mp3", r)
 }
 
+func TestDoJump_RedirectCode(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1",
+		Services: config.ServicesMap{"svc1": {RedirectCode: http.StatusPermanentRedirect, CacheMaxAge: time.Hour}}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(url string) *http.Response {
+		resp, err := client.Get(ts.URL + url)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	resp := get("/api/v1/jump/svc1?url=/file.mp3")
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	assert.Equal(t, "http://srv1.com/file.mp3", resp.Header.Get("Location"))
+	assert.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+	assert.Empty(t, resp.Header.Get("Expires"))
+	assert.Empty(t, resp.Header.Get("Pragma"))
+	assert.Empty(t, resp.Header.Get("X-Accel-Expires"))
+
+	resp = get("/api/v1/jump/svc2?url=/file.mp3")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "default for service not defined")
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "no-cache")
+
+	resp = get("/api/v1/status")
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "no-cache", "other responses not cached")
+
+	srv.SetServices(config.ServicesMap{"svc1": {RedirectCode: http.StatusTemporaryRedirect}})
+	resp = get("/api/v1/jump/svc1?url=/file.mp3")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "no-cache")
+}
+
+func TestDoJump_BadResource(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1",
+		Services: config.ServicesMap{"svc1": {AllowedPaths: []string{`^/rtfiles/.*\.mp3$`}}}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tbl := []struct {
+		svc, resource string
+		code          int
+		location      string
+	}{
+		{"svc1", "/rtfiles/rt_podcast480.mp3", http.StatusFound, "http://srv1.com/rtfiles/rt_podcast480.mp3"},
+		{"svc1", "/rtfiles/rt podcast.mp3?ts=1", http.StatusFound, "http://srv2.com/rtfiles/rt%20podcast.mp3?ts=1"},
+		{"svc1", "/rtfiles/../secret/file.mp3", http.StatusBadRequest, ""},
+		{"svc1", "/rtfiles/file.txt", http.StatusBadRequest, ""},
+		{"svc2", "/any/file.txt", http.StatusFound, "http://srv1.com/any/file.txt"},
+		{"svc2", "/a/../b.mp3", http.StatusFound, "http://srv2.com/b.mp3"},
+		{"svc2", "@evil.com/x", http.StatusBadRequest, ""},
+		{"svc2", ".evil.com/", http.StatusBadRequest, ""},
+		{"svc2", "//evil.com/x", http.StatusBadRequest, ""},
+		{"svc2", "https://evil.com/x", http.StatusBadRequest, ""},
+		{"svc2", "/\\evil.com", http.StatusBadRequest, ""},
+		{"svc2", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.svc+tt.resource, func(t *testing.T) {
+			resp, err := client.Get(ts.URL + "/api/v1/jump/" + tt.svc + "?url=" + url.QueryEscape(tt.resource))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.location, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestDoJump_Path(t *testing.T) {
+	sink := &mockSink{name: "mock"}
+	stats := NewStats(StatsParams{QueueSize: 10}, sink)
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Stats: stats, Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tbl := []struct {
+		method, path string
+		code         int
+		location     string
+	}{
+		{"GET", "/api/v1/jump/svc1/rtfiles/rt_podcast480.mp3", http.StatusFound, "http://srv1.com/rtfiles/rt_podcast480.mp3"},
+		{"HEAD", "/api/v1/jump/svc1/file.mp3?ts=1", http.StatusFound, "http://srv2.com/file.mp3?ts=1"},
+		{"GET", "/svc1/rtfiles/rt%20podcast%3F.mp3", http.StatusFound, "http://srv1.com/rtfiles/rt%20podcast%3F.mp3"},
+		{"HEAD", "/svc1/file.mp3", http.StatusFound, "http://srv2.com/file.mp3"},
+		{"GET", "/api/v1/jump/svc1?url=/file.mp3", http.StatusFound, "http://srv1.com/file.mp3"},
+		{"GET", "/svc1/", http.StatusBadRequest, ""},
+		{"GET", "/api/v1/jump/bad/file.mp3", http.StatusNotFound, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.method+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, http.NoBody)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.location, resp.Header.Get("Location"))
+		})
+	}
+
+	require.NoError(t, stats.Close(context.Background()))
+	var files []string
+	for _, batch := range sink.batches {
+		for _, rec := range batch {
+			assert.Equal(t, "svc1", rec.Service)
+			files = append(files, rec.FileName)
+		}
+	}
+	assert.Equal(t, []string{"rtfiles/rt_podcast480.mp3", "file.mp3", "rtfiles/rt%20podcast%3F.mp3", "file.mp3", "file.mp3"}, files)
+}
+
+func TestDoJump_Signed(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1",
+		Services: config.ServicesMap{
+			"svc1": {Sign: config.SignParams{Secret: "secret1234567890"}},
+			"svc2": {Sign: config.SignParams{NodeSecret: "node-secret", NodeTTL: time.Hour}},
+		}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(link string) *http.Response {
+		resp, err := client.Get(link)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	expires := time.Now().Add(time.Minute)
+	resp := get(sign.Link(ts.URL, "secret1234567890", "svc1", "/rtfiles/rt%20x.mp3?ts=1", expires))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "http://srv1.com/rtfiles/rt%20x.mp3?ts=1", resp.Header.Get("Location"), "signature params stripped")
+
+	q := sign.Query("secret1234567890", "svc1", "/file.mp3", expires)
+	resp = get(ts.URL + "/api/v1/jump/svc1?url=/file.mp3&" + q.Encode())
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "url param form signed the same way")
+	assert.Equal(t, "http://srv2.com/file.mp3", resp.Header.Get("Location"))
+
+	resp = get(ts.URL + "/api/v1/jump/svc1/file.mp3")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "no signature")
+
+	resp = get(sign.Link(ts.URL, "other", "svc1", "/file.mp3", expires))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "bad signature")
+
+	resp = get(ts.URL + "/api/v1/jump/svc1/other.mp3?" + q.Encode())
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "signature of other resource")
+
+	resp = get(sign.Link(ts.URL, "secret1234567890", "svc1", "/file.mp3", time.Now().Add(-time.Minute)))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "expired")
+
+	resp = get(ts.URL + "/api/v1/jump/svc2/file.mp3?expires=1&sig=abc")
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "links of svc2 not signed")
+	u, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/file.mp3", u.Path)
+	assert.Equal(t, "1", u.Query()["expires"][0], "params of unsigned service kept")
+	exp, err := strconv.ParseInt(u.Query()["expires"][1], 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), exp, 5, "node token expires after node ttl")
+	assert.Equal(t, sign.NodeToken("node-secret", "/file.mp3", exp), u.Query().Get(sign.NodeTokenParam))
+
+	srv.SetServices(config.ServicesMap{"svc1": {Sign: config.SignParams{Secret: "secret1234567890", NodeSecret: "node-secret"}}})
+	resp = get(sign.Link(ts.URL, "secret1234567890", "svc1", "/file.mp3", expires))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	u, err = url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(expires.Unix(), 10), u.Query().Get(sign.NodeExpiresParam), "node token expires with the link")
+	assert.Equal(t, sign.NodeToken("node-secret", "/file.mp3", expires.Unix()), u.Query().Get(sign.NodeTokenParam))
+}
+
+func TestDoJump_Referer(t *testing.T) {
+	sink := &mockSink{name: "mock"}
+	stats := NewStats(StatsParams{QueueSize: 10}, sink)
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Stats: stats, Version: "v1",
+		Services: config.ServicesMap{
+			"svc1": {AllowedReferers: []string{"radio-t.com", "*.radio-t.com"}, AllowEmptyReferer: true},
+			"svc2": {AllowedReferers: []string{"radio-t.com"},
+				RefererDenied: config.RefererAction{Action: config.RefererRedirect, URL: "https://radio-t.com/podcast"}},
+			"svc3": {AllowedReferers: []string{"radio-t.com"},
+				RefererDenied: config.RefererAction{Action: config.RefererMessage, Message: "<h1>listen on radio-t.com</h1>"}},
+		}})
+	srv.nodePicker.(*mockPicker).nodes["svc3"] = []picker.Node{{Node: config.Node{Server: "http://srv3.com"}}}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	allowed, denied := testutil.ToFloat64(metrics.RefererChecks.WithLabelValues("svc1", metrics.ResultAllowed)), testutil.ToFloat64(metrics.RefererChecks.WithLabelValues("svc1", metrics.ResultDenied))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tbl := []struct {
+		svc, referer string
+		code         int
+		location     string
+		body         string
+	}{
+		{"svc1", "https://radio-t.com/p/2024/01/01/podcast-900/", http.StatusFound, "http://srv1.com/file.mp3", ""},
+		{"svc1", "https://WWW.radio-t.com:443/", http.StatusFound, "http://srv2.com/file.mp3", ""},
+		{"svc1", "", http.StatusFound, "http://srv1.com/file.mp3", ""},
+		{"svc1", "https://evil.com/?radio-t.com", http.StatusForbidden, "", "referer not allowed\n"},
+		{"svc1", "https://radio-t.com.evil.com/", http.StatusForbidden, "", "referer not allowed\n"},
+		{"svc1", "radio-t.com", http.StatusForbidden, "", "referer not allowed\n"},
+		{"svc2", "", http.StatusFound, "https://radio-t.com/podcast", ""},
+		{"svc2", "https://www.radio-t.com/", http.StatusFound, "https://radio-t.com/podcast", ""},
+		{"svc2", "https://radio-t.com/", http.StatusFound, "http://srv1.com/file.mp3", ""},
+		{"svc3", "https://evil.com/", http.StatusForbidden, "", "<h1>listen on radio-t.com</h1>"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.svc+" "+tt.referer, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+"/api/v1/jump/"+tt.svc+"/file.mp3", http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("Referer", tt.referer)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.location, resp.Header.Get("Location"))
+			if tt.body != "" {
+				assert.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+	assert.Equal(t, allowed+3, testutil.ToFloat64(metrics.RefererChecks.WithLabelValues("svc1", metrics.ResultAllowed)))
+	assert.Equal(t, denied+3, testutil.ToFloat64(metrics.RefererChecks.WithLabelValues("svc1", metrics.ResultDenied)))
+
+	require.NoError(t, stats.Close(context.Background()))
+	var recs []LogRecord
+	for _, batch := range sink.batches {
+		recs = append(recs, batch...)
+	}
+	require.Len(t, recs, len(tbl))
+	assert.False(t, recs[0].RefererDenied)
+	assert.Equal(t, "srv1.com", recs[0].DestHost)
+	assert.True(t, recs[3].RefererDenied)
+	assert.Equal(t, "https://evil.com/?radio-t.com", recs[3].Referer)
+	assert.Equal(t, "file.mp3", recs[3].FileName)
+	assert.Empty(t, recs[3].DestHost)
+}
+
 func TestSubmitStats(t *testing.T) {
 
 	statsSrv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, "/stat", r.URL.Path)
-		lrec := LogRecord{}
+		var recs []LogRecord
 		body, err := io.ReadAll(r.Body)
 		require.NoError(t, err)
-		err = json.Unmarshal(body, &lrec)
+		err = json.Unmarshal(body, &recs)
 		require.NoError(t, err)
+		require.Len(t, recs, 1)
+		lrec := recs[0]
 		assert.Equal(t, "127.0.0.1", lrec.FromIP)
 		assert.Equal(t, "srv1.com", lrec.DestHost)
 		assert.Equal(t, "file123.mp3", lrec.FileName)
@@ -54,21 +305,25 @@ func TestSubmitStats(t *testing.T) {
 	}))
 	defer statsSrv.Close()
 
-	srv := NewRLBServer(newMockPicker(), "error msg", statsSrv.URL+"/stat", 0, "v1")
+	stats := NewStats(StatsParams{QueueSize: 10, FlushInterval: 10 * time.Millisecond},
+		NewHTTPSink(statsSrv.URL+"/stat", time.Second, true))
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Stats: stats, Version: "v1"})
 	ts := httptest.NewServer(srv.routes())
 	defer ts.Close()
-	defer srv.Shutdown()
+	defer srv.Shutdown(0, time.Second)
 
+	submitted := testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+statsSrv.URL+"/stat", "success"))
 	r, err := hit(hitReq{"svc1", "/file123.mp3", ts.URL})
 	assert.NoError(t, err)
 	assert.Equal(t, "http://srv1.com/file123.mp3", r)
 
 	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, submitted+1, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+statsSrv.URL+"/stat", "success")))
 }
 
 func TestRun(t *testing.T) {
 	port := rand.Intn(10000) + 2000 // nolint
-	srv := NewRLBServer(newMockPicker(), "error msg", "", port, "v1")
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Port: port, Version: "v1"})
 
 	go func() {
 		srv.Run()
@@ -77,7 +332,7 @@ func TestRun(t *testing.T) {
 	ts := httptest.NewServer(srv.routes())
 	defer func() {
 		ts.Close()
-		defer srv.Shutdown()
+		defer srv.Shutdown(0, time.Second)
 	}()
 
 	time.Sleep(100 * time.Millisecond) // allow server to start
@@ -124,7 +379,7 @@ func newMockPicker() *mockPicker {
 		ids: map[string]int{},
 		nodes: map[string][]picker.Node{
 			"svc1": {
-				{Node: config.Node{Server: "http://srv1.com"}},
+				{Node: config.Node{Server: "http://srv1.com", Rise: 2, Fall: 3}},
 				{Node: config.Node{Server: "http://srv2.com"}},
 			},
 			"svc2": {
@@ -156,3 +411,231 @@ func (m *mockPicker) Nodes() map[string][]picker.Node {
 func (m *mockPicker) Status() (ok bool, failed []string) {
 	return true, []string{}
 }
+
+func TestDoJump_NoNode(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get(ts.URL + "/api/v1/jump/bad?url=/file.mp3")
+		require.NoError(t, err)
+		defer resp.Body.Close() // nolint
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get()
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "error msg", body)
+
+	srv.SetNoNodeMessage("new error msg")
+	code, body = get()
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "new error msg", body)
+}
+
+func TestStatus(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/status")
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status := struct {
+		Status   string `json:"status"`
+		Services map[string][]struct {
+			Server    string `json:"server"`
+			Alive     bool   `json:"alive"`
+			Successes int    `json:"successes"`
+			Failures  int    `json:"failures"`
+			Rise      int    `json:"rise"`
+			Fall      int    `json:"fall"`
+			Breaker   string `json:"breaker"`
+		} `json:"services"`
+	}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, "ok", status.Status)
+	require.Len(t, status.Services["svc1"], 2)
+	require.Len(t, status.Services["svc2"], 3)
+	assert.Equal(t, "http://srv1.com", status.Services["svc1"][0].Server)
+	assert.Equal(t, 2, status.Services["svc1"][0].Rise)
+	assert.Equal(t, 3, status.Services["svc1"][0].Fall)
+	assert.Equal(t, "closed", status.Services["svc1"][0].Breaker)
+}
+
+func TestPing(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close() // nolint
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/ping")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "pong", body)
+
+	code, _ = get("/api/v1/jump/ping?url=/file.mp3")
+	assert.Equal(t, http.StatusNotFound, code, "only exact /ping handled")
+}
+
+func TestShutdown_Drain(t *testing.T) {
+	var statsDone atomic.Bool
+	statsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		statsDone.Store(true)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer statsSrv.Close()
+
+	stats := NewStats(StatsParams{BatchSize: 10}, NewHTTPSink(statsSrv.URL, time.Second, true))
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Stats: stats, Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	r, err := hit(hitReq{"svc1", "/file123.mp3", ts.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "http://srv1.com/file123.mp3", r)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown(200*time.Millisecond, time.Second)
+		close(done)
+	}()
+
+	// not-ready during drain, but jumps still served
+	require.Eventually(t, func() bool {
+		resp, e := http.Get(ts.URL + "/ping")
+		require.NoError(t, e)
+		defer resp.Body.Close() // nolint
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	resp, err := http.Get(ts.URL + "/api/v1/status")
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	status := struct {
+		Status string `json:"status"`
+	}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, "draining", status.Status)
+
+	_, err = hit(hitReq{"svc2", "/file123.mp3", ts.URL})
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown not completed")
+	}
+	assert.True(t, statsDone.Load(), "shutdown waits for stats submissions")
+}
+
+func TestMetrics(t *testing.T) {
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1",
+		Services: config.ServicesMap{"svc2": {}, "svc3": {}}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	redirects := testutil.ToFloat64(metrics.Redirects.WithLabelValues("svc2", "http://srv1.com"))
+	noNode, unknown := testutil.ToFloat64(metrics.NoNode.WithLabelValues("svc3")), testutil.ToFloat64(metrics.NoNode.WithLabelValues(metrics.UnknownService))
+
+	_, err := hit(hitReq{"svc2", "/file.mp3", ts.URL})
+	require.NoError(t, err)
+	for _, svc := range []string{"svc3", "bad", "random123"} {
+		resp, err := http.Get(ts.URL + "/api/v1/jump/" + svc + "?url=/file.mp3")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+	assert.Equal(t, redirects+1, testutil.ToFloat64(metrics.Redirects.WithLabelValues("svc2", "http://srv1.com")))
+	assert.Equal(t, noNode+1, testutil.ToFloat64(metrics.NoNode.WithLabelValues("svc3")), "configured service with no node")
+	assert.Equal(t, unknown+2, testutil.ToFloat64(metrics.NoNode.WithLabelValues(metrics.UnknownService)), "services not configured")
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "# TYPE rlb_redirects_total counter\n")
+	assert.Contains(t, string(body), `rlb_redirects_total{node="http://srv1.com",service="svc2"} `)
+	assert.Contains(t, string(body), `rlb_no_node_total{service="svc3"} `)
+	assert.Contains(t, string(body), `rlb_no_node_total{service="unknown"} `)
+	assert.NotContains(t, string(body), `rlb_no_node_total{service="random123"}`)
+	assert.Contains(t, string(body), "# TYPE rlb_stats_submissions_total counter\n")
+}
+
+func TestStatsAPI(t *testing.T) {
+	store, err := NewStatsStore(StoreParams{})
+	require.NoError(t, err)
+	defer store.Close()
+	stats := NewStats(StatsParams{FlushInterval: 10 * time.Millisecond}, store)
+	srv := NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Stats: stats, Store: store, Version: "v1"})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, url := range []string{"/file1.mp3", "/file1.mp3", "/file2.mp3"} {
+		_, err = hit(hitReq{"svc2", url, ts.URL})
+		require.NoError(t, err)
+	}
+	get := func(url string, res any) int {
+		resp, e := http.Get(ts.URL + url)
+		require.NoError(t, e)
+		defer resp.Body.Close() // nolint
+		if res != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(res))
+		}
+		return resp.StatusCode
+	}
+
+	var top struct {
+		Svc    string    `json:"svc"`
+		By     string    `json:"by"`
+		Period string    `json:"period"`
+		Items  []TopItem `json:"items"`
+	}
+	assert.Eventually(t, func() bool {
+		return get("/api/v1/stats/top?svc=svc2&period=1d", &top) == http.StatusOK && len(top.Items) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "svc2", top.Svc)
+	assert.Equal(t, "file", top.By)
+	assert.Equal(t, "24h0m0s", top.Period)
+	assert.Equal(t, []TopItem{{Name: "file1.mp3", Count: 2}, {Name: "file2.mp3", Count: 1}}, top.Items)
+
+	require.Equal(t, http.StatusOK, get("/api/v1/stats/top?by=service&limit=1", &top))
+	assert.Equal(t, []TopItem{{Name: "svc2", Count: 3}}, top.Items)
+
+	var timeline struct {
+		Points []TimelinePoint `json:"points"`
+	}
+	require.Equal(t, http.StatusOK, get("/api/v1/stats/timeline?svc=svc2&file=file1.mp3&period=2h", &timeline))
+	require.Len(t, timeline.Points, 2)
+	assert.Equal(t, 2, timeline.Points[1].Count)
+
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/stats/top?period=bad", nil))
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/stats/top?limit=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/stats/top?by=referer", nil))
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/stats/timeline?period=365d", nil))
+
+	// no store, no stats api
+	srv = NewRLBServer(newMockPicker(), Opts{NoNodeMessage: "error msg", Version: "v1"})
+	ts2 := httptest.NewServer(srv.routes())
+	defer ts2.Close()
+	resp, err := http.Get(ts2.URL + "/api/v1/stats/top")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+}
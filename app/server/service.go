@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/sign"
+)
+
+// service is a service from config with compiled patterns
+type service struct {
+	config.Service
+	allowedPaths []*regexp.Regexp
+	referers     hostRoutes // allowed referer hosts, mapped to themselves
+}
+
+// makeServices compiles patterns of services. Invalid pattern, rejected by config validation anyway, skipped,
+// so a service with no valid pattern allows nothing.
+func makeServices(services config.ServicesMap) map[string]service {
+	res := make(map[string]service, len(services))
+	for name, svc := range services {
+		s := service{Service: svc}
+		for _, p := range svc.AllowedPaths {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				log.Printf("[WARN] invalid allowed path %q of %s, %v", p, name, err)
+				continue
+			}
+			s.allowedPaths = append(s.allowedPaths, re)
+		}
+		referers := make(map[string]string, len(svc.AllowedReferers))
+		for _, ref := range svc.AllowedReferers {
+			referers[ref] = ref
+		}
+		s.referers = makeHostRoutes(referers)
+		res[name] = s
+	}
+	return res
+}
+
+// allowed checks path of normalized resource, without query, matches any of allowed paths.
+// Any resource allowed if no allowed paths defined.
+func (s service) allowed(resource string) bool {
+	if len(s.AllowedPaths) == 0 {
+		return true
+	}
+	path, _, _ := strings.Cut(resource, "?")
+	for _, re := range s.allowedPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// refererAllowed checks host of request's referer matches any of allowed referers. Any referer allowed if
+// no allowed referers defined, empty one allowed only if the service allows it.
+func (s service) refererAllowed(r *http.Request) bool {
+	if len(s.AllowedReferers) == 0 {
+		return true
+	}
+	referer := r.Referer()
+	if referer == "" {
+		return s.AllowEmptyReferer
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	_, ok := s.referers.service(u.Host)
+	return ok
+}
+
+// denyReferer responds to request with referer not allowed by service's action, 403 by default
+func (s service) denyReferer(w http.ResponseWriter, r *http.Request) {
+	switch s.RefererDenied.Action {
+	case config.RefererRedirect:
+		http.Redirect(w, r, s.RefererDenied.URL, http.StatusFound)
+	case config.RefererMessage:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(s.RefererDenied.Message))
+	default:
+		http.Error(w, "referer not allowed", http.StatusForbidden)
+	}
+}
+
+// verify checks signature of the link to resource of svc, if service's links signed
+func (s service) verify(r *http.Request, svc, resource string) error {
+	if s.Sign.Secret == "" {
+		return nil
+	}
+	q := r.URL.Query()
+	return sign.Verify(s.Sign.Secret, svc, resource, q.Get(sign.ExpiresParam), q.Get(sign.SigParam), time.Now())
+}
+
+// addNodeToken adds nginx secure_link token to redirect url, if service's node secret defined.
+// Token expires with the signed link, or after node ttl if links not signed.
+func (s service) addNodeToken(r *http.Request, redirURL string) (string, error) {
+	if s.Sign.NodeSecret == "" {
+		return redirURL, nil
+	}
+	expires := time.Now().Add(s.Sign.NodeTTL)
+	if s.Sign.Secret != "" {
+		if exp, err := strconv.ParseInt(r.URL.Query().Get(sign.ExpiresParam), 10, 64); err == nil {
+			expires = time.Unix(exp, 0)
+		}
+	}
+	return sign.AddNodeToken(redirURL, s.Sign.NodeSecret, expires)
+}
+
+// redirect responds with service's redirect code, 302 if not defined. Redirect with cache max-age gets
+// cache headers instead of no-cache headers set by middleware for all responses.
+func (s service) redirect(w http.ResponseWriter, r *http.Request, redirURL string) {
+	code := http.StatusFound
+	if s.RedirectCode != 0 {
+		code = s.RedirectCode
+	}
+	if s.CacheMaxAge > 0 {
+		for _, h := range []string{"Expires", "Pragma", "X-Accel-Expires"} {
+			w.Header().Del(h)
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.CacheMaxAge.Seconds())))
+	}
+	http.Redirect(w, r, redirURL, code)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// StatsSink writes batches of log records somewhere, i.e. to a remote service or a file.
+// Write called concurrently by stats workers and returns number of records written, n < len(recs) on error.
+// Failed Write retried with records not written yet, so sinks writing records one by one don't get duplicates.
+type StatsSink interface {
+	fmt.Stringer
+	Write(ctx context.Context, recs []LogRecord) (n int, err error)
+	Close() error
+}
+
+// HTTPSink POSTs batches as JSON array, or every record as a separate request with a single JSON record
+// expected by services made for the legacy --stats url, like rlb-stats
+type HTTPSink struct {
+	url    string
+	batch  bool
+	client *http.Client
+}
+
+// NewHTTPSink makes sink posting to url with request timeout, batch sets JSON array format
+func NewHTTPSink(url string, timeout time.Duration, batch bool) *HTTPSink {
+	return &HTTPSink{url: url, batch: batch, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *HTTPSink) String() string { return "http:" + s.url }
+
+// Write posts records as JSON array, or one by one till the first failure if not batched.
+// Any status but 200 is a failure, failed batch counted as not written at all.
+// Records denied by referer check skipped if not batched, legacy services count every record as a download.
+func (s *HTTPSink) Write(ctx context.Context, recs []LogRecord) (n int, err error) {
+	if s.batch {
+		if err = s.post(ctx, recs); err != nil {
+			return 0, err
+		}
+		return len(recs), nil
+	}
+	for i, rec := range recs {
+		if rec.RefererDenied {
+			continue
+		}
+		if err = s.post(ctx, rec); err != nil {
+			return i, err
+		}
+	}
+	return len(recs), nil
+}
+
+// post marshals v and posts it as JSON
+func (s *HTTPSink) post(ctx context.Context, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("can't marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("can't make request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote call failed: %w", err)
+	}
+	defer func() {
+		if e := resp.Body.Close(); e != nil {
+			log.Printf("[WARN] failed to close response body, %v", e)
+		}
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("[WARN] failed to read response body, %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code %d, body %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Close does nothing, no resources kept between requests
+func (s *HTTPSink) Close() error { return nil }
+
+// FileSink appends records to a file, one JSON per line. File rotated when it grows over maxSize,
+// the current file renamed to path.1, path.1 to path.2 and so on, files over maxBackups removed.
+type FileSink struct {
+	path       string
+	maxSize    int64 // 0 disables rotation
+	maxBackups int
+
+	lock   sync.Mutex
+	file   *os.File // nil if closed or failed to reopen, reopened by the next Write
+	size   int64
+	closed bool
+}
+
+// NewFileSink opens file sink at path, maxSize in bytes
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	res := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *FileSink) String() string { return "file:" + s.path }
+
+// Write appends records, file rotated before the write if it doesn't fit.
+// On partial write the last incomplete line cut off, so only complete records are in the file.
+func (s *FileSink) Write(_ context.Context, recs []LogRecord) (n int, err error) {
+	var buf bytes.Buffer
+	ends := make([]int, 0, len(recs)) // end offset of each record in buf
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err = enc.Encode(rec); err != nil {
+			return 0, fmt.Errorf("can't marshal: %w", err)
+		}
+		ends = append(ends, buf.Len())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, fmt.Errorf("file %s closed", s.path)
+	}
+	if s.file == nil {
+		if err = s.open(); err != nil {
+			return 0, err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return 0, fmt.Errorf("can't rotate %s: %w", s.path, err)
+		}
+	}
+	written, err := s.file.Write(buf.Bytes())
+	if err == nil {
+		s.size += int64(written)
+		return len(recs), nil
+	}
+
+	for n < len(ends) && ends[n] <= written {
+		n++
+	}
+	complete := 0
+	if n > 0 {
+		complete = ends[n-1]
+	}
+	if complete < written {
+		if e := s.file.Truncate(s.size + int64(complete)); e != nil {
+			log.Printf("[WARN] can't cut incomplete record off %s, %v", s.path, e)
+			complete = written
+		}
+	}
+	s.size += int64(complete)
+	return n, fmt.Errorf("can't write to %s: %w", s.path, err)
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileSink) open() error {
+	fh, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640) // nolint:gosec // path from the config
+	if err != nil {
+		return fmt.Errorf("can't open %s: %w", s.path, err)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("can't stat %s: %w", s.path, err)
+	}
+	s.file, s.size = fh, fi.Size()
+	return nil
+}
+
+// rotate shifts backups, renames the current file to the first backup and opens a new one.
+// If shifting failed, the current file reopened to keep the sink working, rotation retried on the next write.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		log.Printf("[WARN] failed to close %s, %v", s.path, err)
+	}
+	s.file = nil
+
+	if err := s.shift(); err != nil {
+		if e := s.open(); e != nil {
+			log.Printf("[WARN] can't reopen %s after failed rotation, %v", s.path, e)
+		}
+		return err
+	}
+	return s.open()
+}
+
+// shift renames backups and the current file, or removes the current file if no backups kept
+func (s *FileSink) shift() error {
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+// SyslogSink sends every record to syslog as JSON, with info priority
+type SyslogSink struct {
+	addr   string
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to syslog at network and address, local syslog used if both empty
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "rlb"
+	}
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to syslog %s %s: %w", network, address, err)
+	}
+	addr := "local"
+	if address != "" {
+		addr = network + "://" + address
+	}
+	return &SyslogSink{addr: addr, writer: w}, nil
+}
+
+func (s *SyslogSink) String() string { return "syslog:" + s.addr }
+
+// Write sends records one by one, stops on the first failure
+func (s *SyslogSink) Write(_ context.Context, recs []LogRecord) (n int, err error) {
+	for i, rec := range recs {
+		var data []byte
+		if data, err = json.Marshal(rec); err != nil {
+			return i, fmt.Errorf("can't marshal: %w", err)
+		}
+		if err = s.writer.Info(string(data)); err != nil {
+			return i, fmt.Errorf("can't write to syslog %s: %w", s.addr, err)
+		}
+	}
+	return len(recs), nil
+}
+
+// Close closes connection to syslog
+func (s *SyslogSink) Close() error { return s.writer.Close() }
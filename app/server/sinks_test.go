@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSink(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var recs []LogRecord
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&recs))
+		assert.Equal(t, []LogRecord{{ID: "1", Service: "svc1"}}, recs)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL, time.Second, true)
+	assert.Equal(t, "http:"+ts.URL, sink.String())
+	n, err := sink.Write(context.Background(), []LogRecord{{ID: "1", Service: "svc1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	status = http.StatusInternalServerError
+	n, err = sink.Write(context.Background(), []LogRecord{{ID: "1", Service: "svc1"}})
+	assert.EqualError(t, err, "bad status code 500, body ")
+	assert.Equal(t, 0, n, "failed batch not written")
+	assert.NoError(t, sink.Close())
+}
+
+func TestHTTPSink_Single(t *testing.T) {
+	var ids []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec LogRecord
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&rec), "a record per request, not an array")
+		ids = append(ids, rec.ID)
+		if rec.ID == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL, time.Second, false)
+	n, err := sink.Write(context.Background(), []LogRecord{{ID: "1"}, {ID: "2"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"1", "2"}, ids)
+
+	ids = nil
+	n, err = sink.Write(context.Background(), []LogRecord{{ID: "3"}, {ID: "bad"}, {ID: "4"}})
+	assert.EqualError(t, err, "bad status code 400, body ")
+	assert.Equal(t, 1, n, "records before the failed one written")
+	assert.Equal(t, []string{"3", "bad"}, ids, "stopped on the first failure")
+
+	ids = nil
+	n, err = sink.Write(context.Background(), []LogRecord{{ID: "5"}, {ID: "denied", RefererDenied: true}, {ID: "6"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n, "denied record counted as handled")
+	assert.Equal(t, []string{"5", "6"}, ids, "denied record not posted")
+}
+
+func TestFileSink(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "stats.ndjson")
+	sink, err := NewFileSink(fname, 100, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "file:"+fname, sink.String())
+
+	rec := func(id string) LogRecord { return LogRecord{ID: id, FileName: "f.mp3", Service: "svc"} }
+	// each record is about 80 bytes, so every write but the first one rotates the file
+	for _, id := range []string{"1", "2", "3", "4"} {
+		_, err = sink.Write(context.Background(), []LogRecord{rec(id)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, sink.Close())
+
+	readIDs := func(name string) (ids []string) {
+		data, e := os.ReadFile(name)
+		require.NoError(t, e)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var r LogRecord
+			require.NoError(t, json.Unmarshal([]byte(line), &r))
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"4"}, readIDs(fname))
+	assert.Equal(t, []string{"3"}, readIDs(fname+".1"))
+	assert.Equal(t, []string{"2"}, readIDs(fname+".2"))
+	_, err = os.Stat(fname + ".3")
+	assert.True(t, os.IsNotExist(err), "only 2 backups kept")
+
+	n, err := sink.Write(context.Background(), []LogRecord{rec("5")})
+	assert.Error(t, err, "closed")
+	assert.Equal(t, 0, n)
+
+	// reopened sink appends to existing file
+	sink, err = NewFileSink(fname, 0, 0)
+	require.NoError(t, err)
+	n, err = sink.Write(context.Background(), []LogRecord{rec("5"), rec("6")})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, sink.Close())
+	assert.Equal(t, []string{"4", "5", "6"}, readIDs(fname))
+
+	_, err = NewFileSink("/no-such-dir/stats.ndjson", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestFileSink_RotateFailed(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "stats.ndjson")
+	sink, err := NewFileSink(fname, 100, 1)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	// leftover directory in place of the backup makes rotation fail
+	require.NoError(t, os.MkdirAll(filepath.Join(fname+".1", "sub"), 0o750))
+	rec := func(id string) LogRecord { return LogRecord{ID: id, FileName: "f.mp3", Service: "svc"} }
+	_, err = sink.Write(context.Background(), []LogRecord{rec("1")})
+	require.NoError(t, err)
+	n, err := sink.Write(context.Background(), []LogRecord{rec("2")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't rotate")
+	assert.Equal(t, 0, n)
+
+	// sink works again as soon as the cause fixed
+	require.NoError(t, os.RemoveAll(fname+".1"))
+	n, err = sink.Write(context.Background(), []LogRecord{rec("2")})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	data, err := os.ReadFile(fname + ".1")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"id":"1"`)
+	data, err = os.ReadFile(fname)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"id":"2"`)
+}
+
+func TestSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close() // nolint
+
+	sink, err := NewSyslogSink("udp", conn.LocalAddr().String(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "syslog:udp://"+conn.LocalAddr().String(), sink.String())
+	n, err := sink.Write(context.Background(), []LogRecord{{ID: "1", Service: "svc1"}, {ID: "2", Service: "svc1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, sink.Close())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1024)
+	for _, id := range []string{"1", "2"} {
+		n, _, e := conn.ReadFrom(buf)
+		require.NoError(t, e)
+		msg := string(buf[:n])
+		assert.True(t, strings.HasPrefix(msg, "<14>"), "user.info priority, %s", msg)
+		assert.Contains(t, msg, " rlb[")
+		assert.Contains(t, msg, `{"id":"`+id+`"`)
+	}
+}
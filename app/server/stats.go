@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/rlb/app/metrics"
+)
+
+// StatsParams defines stats pipeline
+type StatsParams struct {
+	QueueSize     int           // max records waiting for submission to a sink, records dropped on overflow
+	Workers       int           // number of concurrent submitters of a sink
+	BatchSize     int           // max records in a single request
+	FlushInterval time.Duration // max time a record waits for the batch to fill
+	Retries       int           // retries of a failed batch
+	Backoff       time.Duration // delay before the first retry, doubled for each next one
+}
+
+// Stats submits log records to sinks in batches. Every sink has its own queue and pool of workers,
+// so slow or failing sink doesn't delay others. Submit queues record for each sink without blocking
+// and drops it for the sink with full queue. Workers collect records into batches up to BatchSize
+// or FlushInterval and write them to the sink, failed batch retried with exponential backoff.
+type Stats struct {
+	queues []sinkQueue
+	params StatsParams
+	wg     sync.WaitGroup
+
+	ctx    context.Context // canceled if Close timed out, aborts requests and retries
+	cancel context.CancelFunc
+
+	lock   sync.RWMutex // guards closed and queues close
+	closed bool
+}
+
+// sinkQueue is a sink with records waiting for its workers
+type sinkQueue struct {
+	sink  StatsSink
+	queue chan LogRecord
+}
+
+// NewStats makes stats submitter for sinks and starts workers of each sink
+func NewStats(params StatsParams, sinks ...StatsSink) *Stats {
+	params.QueueSize = max(params.QueueSize, 1)
+	params.Workers = max(params.Workers, 1)
+	params.BatchSize = max(params.BatchSize, 1)
+	if params.FlushInterval <= 0 {
+		params.FlushInterval = time.Second
+	}
+
+	res := &Stats{params: params}
+	res.ctx, res.cancel = context.WithCancel(context.Background())
+	for _, sink := range sinks {
+		q := sinkQueue{sink: sink, queue: make(chan LogRecord, params.QueueSize)}
+		res.queues = append(res.queues, q)
+		for range params.Workers {
+			res.wg.Add(1)
+			go func() {
+				defer res.wg.Done()
+				res.worker(q)
+			}()
+		}
+	}
+	log.Printf("[DEBUG] stats submitter for %v started, %+v", sinks, params)
+	return res
+}
+
+// Submit queues record for submission to all sinks. Returns false if record dropped for any sink
+// with full queue, or submitter closed.
+func (s *Stats) Submit(rec LogRecord) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return false
+	}
+	res := true
+	for _, q := range s.queues {
+		select {
+		case q.queue <- rec:
+		default:
+			metrics.StatsDropped.WithLabelValues(q.sink.String()).Inc()
+			res = false
+		}
+	}
+	return res
+}
+
+// Close stops accepting records, waits for queued records submitted and closes sinks. If ctx done first,
+// writes and retries in progress aborted and not submitted records lost.
+func (s *Stats) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, q := range s.queues {
+			close(q.queue)
+		}
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("stats not submitted: %w", ctx.Err())
+	}
+	s.cancel()
+	<-done
+
+	for _, q := range s.queues {
+		if e := q.sink.Close(); e != nil {
+			err = errors.Join(err, fmt.Errorf("can't close %s: %w", q.sink, e))
+		}
+	}
+	return err
+}
+
+// worker collects records from the sink's queue into batches and writes them, the last batch written on queue close
+func (s *Stats) worker(q sinkQueue) {
+	batch := make([]LogRecord, 0, s.params.BatchSize)
+	ticker := time.NewTicker(s.params.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case rec, ok := <-q.queue:
+			if !ok {
+				s.write(q.sink, batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= s.params.BatchSize {
+				s.write(q.sink, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.write(q.sink, batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write writes batch to sink with retries, retry writes records not written by the failed attempt only
+func (s *Stats) write(sink StatsSink, batch []LogRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := s.params.Backoff
+	for attempt := 0; ; attempt++ {
+		n, err := sink.Write(s.ctx, batch)
+		n = min(max(n, 0), len(batch))
+		metrics.StatsSubmissions.WithLabelValues(sink.String(), metrics.ResultSuccess).Add(float64(n))
+		batch = batch[n:]
+		if err == nil {
+			return
+		}
+		if attempt >= s.params.Retries || s.ctx.Err() != nil {
+			log.Printf("[WARN] can't submit %d stats records to %s, %v", len(batch), sink, err)
+			metrics.StatsSubmissions.WithLabelValues(sink.String(), metrics.ResultFailure).Add(float64(len(batch)))
+			return
+		}
+		log.Printf("[DEBUG] can't submit %d stats records to %s, retry in %v, %v", len(batch), sink, backoff, err)
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/metrics"
+)
+
+func TestStats_Batches(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]LogRecord
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var recs []LogRecord
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&recs))
+		lock.Lock()
+		batches = append(batches, recs)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	submitted := testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "success"))
+	stats := NewStats(StatsParams{QueueSize: 100, Workers: 1, BatchSize: 3, FlushInterval: time.Minute},
+		NewHTTPSink(ts.URL, time.Second, true))
+	for i := 0; i < 7; i++ {
+		assert.True(t, stats.Submit(LogRecord{ID: string(rune('a' + i))}))
+	}
+
+	// full batches sent right away, the rest on close
+	require.Eventually(t, func() bool { lock.Lock(); defer lock.Unlock(); return len(batches) == 2 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, stats.Close(context.Background()))
+	assert.False(t, stats.Submit(LogRecord{ID: "x"}), "closed")
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, batches, 3)
+	assert.Len(t, batches[0], 3)
+	assert.Len(t, batches[1], 3)
+	assert.Equal(t, []LogRecord{{ID: "g"}}, batches[2])
+	assert.Equal(t, submitted+7, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "success")))
+}
+
+func TestStats_FlushInterval(t *testing.T) {
+	var count atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var recs []LogRecord
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&recs))
+		count.Add(int32(len(recs)))
+	}))
+	defer ts.Close()
+
+	stats := NewStats(StatsParams{QueueSize: 100, Workers: 2, BatchSize: 100, FlushInterval: 20 * time.Millisecond},
+		NewHTTPSink(ts.URL, time.Second, true))
+	defer stats.Close(context.Background()) // nolint
+	stats.Submit(LogRecord{ID: "1"})
+	stats.Submit(LogRecord{ID: "2"})
+	require.Eventually(t, func() bool { return count.Load() == 2 }, time.Second, 10*time.Millisecond, "partial batch flushed")
+}
+
+func TestStats_Retry(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	submitted, failed := testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "success")), testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "failure"))
+	stats := NewStats(StatsParams{QueueSize: 10, Workers: 1, BatchSize: 1,
+		Retries: 2, Backoff: 10 * time.Millisecond}, NewHTTPSink(ts.URL, time.Second, true))
+	stats.Submit(LogRecord{ID: "1"})
+	require.NoError(t, stats.Close(context.Background()))
+	assert.Equal(t, int32(3), calls.Load(), "succeeded on the second retry")
+	assert.Equal(t, submitted+1, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "success")))
+	assert.Equal(t, failed, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "failure")))
+
+	// retries exhausted
+	calls.Store(-10)
+	stats = NewStats(StatsParams{QueueSize: 10, Workers: 1, BatchSize: 1,
+		Retries: 1, Backoff: 10 * time.Millisecond}, NewHTTPSink(ts.URL, time.Second, true))
+	stats.Submit(LogRecord{ID: "1"})
+	require.NoError(t, stats.Close(context.Background()))
+	assert.Equal(t, int32(-8), calls.Load())
+	assert.Equal(t, failed+1, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("http:"+ts.URL, "failure")))
+}
+
+func TestStats_Overflow(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) { <-block }))
+	defer ts.Close()
+	defer close(block)
+
+	dropped := testutil.ToFloat64(metrics.StatsDropped.WithLabelValues("http:" + ts.URL))
+	stats := NewStats(StatsParams{QueueSize: 2, Workers: 1, BatchSize: 1}, NewHTTPSink(ts.URL, time.Minute, true))
+	require.True(t, stats.Submit(LogRecord{ID: "1"}))
+	time.Sleep(50 * time.Millisecond) // the first record picked by worker and stuck in request
+	assert.True(t, stats.Submit(LogRecord{ID: "2"}))
+	assert.True(t, stats.Submit(LogRecord{ID: "3"}))
+	assert.False(t, stats.Submit(LogRecord{ID: "4"}), "queue is full")
+	assert.Equal(t, dropped+1, testutil.ToFloat64(metrics.StatsDropped.WithLabelValues("http:"+ts.URL)))
+
+	// close gives up on timeout and aborts stuck request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	err := stats.Close(ctx)
+	require.Error(t, err)
+	assert.Less(t, time.Since(st), time.Second)
+}
+
+func TestStats_MultipleSinks(t *testing.T) {
+	good := &mockSink{name: "good"}
+	bad := &mockSink{name: "bad", err: errors.New("failed")}
+	stats := NewStats(StatsParams{QueueSize: 10, Workers: 1, BatchSize: 2, Retries: 2, Backoff: time.Millisecond}, bad, good)
+	stats.Submit(LogRecord{ID: "1"})
+	stats.Submit(LogRecord{ID: "2"})
+	require.NoError(t, stats.Close(context.Background()))
+
+	assert.Equal(t, [][]LogRecord{{{ID: "1"}, {ID: "2"}}}, good.batches, "failed sink doesn't affect others")
+	assert.Equal(t, 3, bad.calls, "failed sink retried")
+	assert.True(t, good.closed)
+	assert.True(t, bad.closed)
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("bad", "failure")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("good", "success")))
+}
+
+func TestStats_SlowSink(t *testing.T) {
+	slow := &mockSink{name: "slow", block: make(chan struct{})}
+	good := &mockSink{name: "good-fast"}
+	stats := NewStats(StatsParams{QueueSize: 2, Workers: 1, BatchSize: 1}, slow, good)
+	for i := range 5 {
+		stats.Submit(LogRecord{ID: strconv.Itoa(i)})
+		time.Sleep(10 * time.Millisecond) // records picked by the good sink one by one
+	}
+	require.Eventually(t, func() bool { return good.written() == 5 }, time.Second, 10*time.Millisecond,
+		"good sink not delayed by stuck one")
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.StatsDropped.WithLabelValues("good-fast")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.StatsDropped.WithLabelValues("slow")), "1 stuck in write, 2 queued")
+
+	close(slow.block)
+	require.NoError(t, stats.Close(context.Background()))
+	assert.Equal(t, 3, slow.written())
+}
+
+func TestStats_PartialWrite(t *testing.T) {
+	sink := &mockSink{name: "partial", err: errors.New("failed"), limit: 1}
+	stats := NewStats(StatsParams{QueueSize: 10, Workers: 1, BatchSize: 3, Retries: 2, Backoff: time.Millisecond}, sink)
+	stats.Submit(LogRecord{ID: "1"})
+	stats.Submit(LogRecord{ID: "2"})
+	stats.Submit(LogRecord{ID: "3"})
+	require.NoError(t, stats.Close(context.Background()))
+
+	assert.Equal(t, [][]LogRecord{{{ID: "1"}}, {{ID: "2"}}, {{ID: "3"}}}, sink.batches, "written records not retried")
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("partial", "success")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.StatsSubmissions.WithLabelValues("partial", "failure")))
+}
+
+type mockSink struct {
+	name    string
+	err     error
+	limit   int           // records written before err
+	block   chan struct{} // write waits for it, if set
+	lock    sync.Mutex
+	calls   int
+	batches [][]LogRecord
+	closed  bool
+}
+
+func (m *mockSink) String() string { return m.name }
+
+func (m *mockSink) Write(_ context.Context, recs []LogRecord) (int, error) {
+	if m.block != nil {
+		<-m.block
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls++
+	if m.err != nil {
+		recs = recs[:min(m.limit, len(recs))]
+	}
+	if len(recs) > 0 {
+		m.batches = append(m.batches, append([]LogRecord(nil), recs...))
+	}
+	return len(recs), m.err
+}
+
+func (m *mockSink) written() (res int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, b := range m.batches {
+		res += len(b)
+	}
+	return res
+}
+
+func (m *mockSink) Close() error {
+	m.closed = true
+	return nil
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// StatsStore is a stats sink aggregating records into per-service, per-file and per-node counters
+// in time buckets. Buckets older than retention dropped. Counters persisted to file periodically and on Close,
+// and loaded back on start.
+type StatsStore struct {
+	path      string
+	bucket    time.Duration
+	retention time.Duration
+
+	lock     sync.RWMutex
+	buckets  map[int64]map[string]*svcCounts // bucket start unix time -> service -> counters
+	dirty    bool
+	prunedTo int64 // buckets before this one already dropped
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StoreParams defines stats store
+type StoreParams struct {
+	Path         string        // file to persist counters, in-memory only if empty
+	Bucket       time.Duration // time bucket size in whole seconds, 1h if not defined
+	Retention    time.Duration // max age of buckets, 30 days if not defined
+	SaveInterval time.Duration // how often counters saved to file, 1m if not defined
+}
+
+// svcCounts are counters of a service in a bucket
+type svcCounts struct {
+	Total int            `json:"total"`
+	Files map[string]int `json:"files"`
+	Nodes map[string]int `json:"nodes"`
+}
+
+// TopItem is a name with its downloads count
+type TopItem struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// TimelinePoint is downloads count in a bucket starting at TS
+type TimelinePoint struct {
+	TS    time.Time `json:"ts"`
+	Count int       `json:"count"`
+}
+
+// grouping keys for Top
+const (
+	TopByFile    = "file"
+	TopByNode    = "node"
+	TopByService = "service"
+)
+
+// NewStatsStore makes store and loads counters saved before, if any
+func NewStatsStore(params StoreParams) (*StatsStore, error) {
+	params.Bucket = params.Bucket.Truncate(time.Second) // buckets keyed by unix seconds
+	if params.Bucket <= 0 {
+		params.Bucket = time.Hour
+	}
+	if params.Retention <= 0 {
+		params.Retention = 30 * 24 * time.Hour
+	}
+	if params.SaveInterval <= 0 {
+		params.SaveInterval = time.Minute
+	}
+
+	res := &StatsStore{path: params.Path, bucket: params.Bucket, retention: params.Retention,
+		buckets: map[int64]map[string]*svcCounts{}, done: make(chan struct{})}
+	if err := res.load(); err != nil {
+		return nil, err
+	}
+	if res.path != "" {
+		res.wg.Add(1)
+		go func() {
+			defer res.wg.Done()
+			res.saveLoop(params.SaveInterval)
+		}()
+	}
+	return res, nil
+}
+
+func (s *StatsStore) String() string { return "store:" + s.path }
+
+// Write adds records to counters of their time buckets, records denied by referer check skipped
+func (s *StatsStore) Write(_ context.Context, recs []LogRecord) (n int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.prune(now)
+	minTS := now.Add(-s.retention).Unix()
+	for _, rec := range recs {
+		ts := s.bucketStart(rec.TS)
+		if ts < minTS || rec.RefererDenied {
+			continue
+		}
+		counts := s.counts(ts, rec.Service)
+		counts.Total++
+		counts.Files[rec.FileName]++
+		counts.Nodes[rec.DestHost]++
+	}
+	s.dirty = true
+	return len(recs), nil
+}
+
+// Close stops periodic saving and saves counters
+func (s *StatsStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.save()
+}
+
+// Top returns up to limit items with the most downloads for the last period, grouped by file, node or service.
+// Empty svc counts all services. Items with the same count ordered by name.
+func (s *StatsStore) Top(svc, by string, period time.Duration, limit int) ([]TopItem, error) {
+	switch by {
+	case TopByFile, TopByNode, TopByService:
+	default:
+		return nil, fmt.Errorf("unsupported grouping %q, allowed %s, %s or %s", by, TopByFile, TopByNode, TopByService)
+	}
+
+	counts := map[string]int{}
+	err := s.scan(svc, period, func(_ int64, name string, c *svcCounts) {
+		switch by {
+		case TopByFile:
+			for f, n := range c.Files {
+				counts[f] += n
+			}
+		case TopByNode:
+			for node, n := range c.Nodes {
+				counts[node] += n
+			}
+		case TopByService:
+			counts[name] += c.Total
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]TopItem, 0, len(counts))
+	for name, n := range counts {
+		res = append(res, TopItem{Name: name, Count: n})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Name < res[j].Name
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// Timeline returns downloads per bucket for the last period, from the oldest bucket, including empty ones.
+// Empty svc counts all services, non-empty file counts only this file.
+func (s *StatsStore) Timeline(svc, file string, period time.Duration) ([]TimelinePoint, error) {
+	counts := map[int64]int{}
+	err := s.scan(svc, period, func(ts int64, _ string, c *svcCounts) {
+		if file == "" {
+			counts[ts] += c.Total
+			return
+		}
+		counts[ts] += c.Files[file]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	last := s.bucketStart(time.Now())
+	first := s.bucketStart(time.Now().Add(-period + s.bucket))
+	step := int64(s.bucket / time.Second)
+	res := make([]TimelinePoint, 0, (last-first)/step+1)
+	for ts := first; ts <= last; ts += step {
+		res = append(res, TimelinePoint{TS: time.Unix(ts, 0).UTC(), Count: counts[ts]})
+	}
+	return res, nil
+}
+
+// scan calls fn for counters of svc (or all services if empty) in buckets of the last period
+func (s *StatsStore) scan(svc string, period time.Duration, fn func(ts int64, svc string, c *svcCounts)) error {
+	if period <= 0 || period > s.retention {
+		return fmt.Errorf("period %v out of (0..%v] range", period, s.retention)
+	}
+	minTS := s.bucketStart(time.Now().Add(-period + s.bucket))
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for ts, services := range s.buckets {
+		if ts < minTS {
+			continue
+		}
+		for name, c := range services {
+			if svc == "" || svc == name {
+				fn(ts, name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// counts returns counters of svc in bucket ts, made if not exists. Should be called under lock.
+func (s *StatsStore) counts(ts int64, svc string) *svcCounts {
+	services, ok := s.buckets[ts]
+	if !ok {
+		services = map[string]*svcCounts{}
+		s.buckets[ts] = services
+	}
+	c, ok := services[svc]
+	if !ok {
+		c = &svcCounts{Files: map[string]int{}, Nodes: map[string]int{}}
+		services[svc] = c
+	}
+	return c
+}
+
+func (s *StatsStore) bucketStart(t time.Time) int64 {
+	return t.Truncate(s.bucket).Unix()
+}
+
+func (s *StatsStore) saveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Printf("[WARN] can't save stats, %v", err)
+			}
+		}
+	}
+}
+
+// prune drops buckets expired at now, runs once per bucket. Called by Write, so in-memory store
+// applies retention too. Should be called under lock.
+func (s *StatsStore) prune(now time.Time) {
+	minTS := s.bucketStart(now.Add(-s.retention))
+	if minTS <= s.prunedTo {
+		return
+	}
+	for ts := range s.buckets {
+		if ts < minTS {
+			delete(s.buckets, ts)
+			s.dirty = true
+		}
+	}
+	s.prunedTo = minTS
+}
+
+// save drops expired buckets and writes counters to temp file renamed to the store file, does nothing if not changed
+func (s *StatsStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	s.prune(time.Now())
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	data := make(map[string]map[string]*svcCounts, len(s.buckets))
+	for ts, services := range s.buckets {
+		data[strconv.FormatInt(ts, 10)] = services
+	}
+	body, err := json.Marshal(data)
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("can't marshal stats: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("can't make temp file: %w", err)
+	}
+	if _, err = tmp.Write(body); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("can't write %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("can't close %s: %w", tmp.Name(), err)
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("can't rename to %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// load reads counters saved before, buckets re-aligned to the current bucket size
+func (s *StatsStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	body, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read %s: %w", s.path, err)
+	}
+
+	data := map[string]map[string]*svcCounts{}
+	if err = json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("can't parse %s: %w", s.path, err)
+	}
+	for key, services := range data {
+		unix, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket %q in %s: %w", key, s.path, err)
+		}
+		ts := s.bucketStart(time.Unix(unix, 0))
+		for svc, c := range services {
+			counts := s.counts(ts, svc)
+			counts.Total += c.Total
+			for f, n := range c.Files {
+				counts.Files[f] += n
+			}
+			for node, n := range c.Nodes {
+				counts.Nodes[node] += n
+			}
+		}
+	}
+	log.Printf("[INFO] stats loaded from %s, %d buckets", s.path, len(s.buckets))
+	return nil
+}
+
+// ParsePeriod parses duration like time.ParseDuration, with additional d suffix for days, i.e. 7d
+func ParsePeriod(period string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(period, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %q", period)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, fmt.Errorf("invalid period %q", period)
+	}
+	return d, nil
+}
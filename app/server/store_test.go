@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsStore_Top(t *testing.T) {
+	store, err := NewStatsStore(StoreParams{Bucket: time.Hour, Retention: 48 * time.Hour})
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now()
+	rec := func(svc, file, node string, ts time.Time) LogRecord {
+		return LogRecord{Service: svc, FileName: file, DestHost: node, TS: ts}
+	}
+	writeRecs(t, store, []LogRecord{
+		rec("podcast", "a.mp3", "n1", now),
+		rec("podcast", "a.mp3", "n2", now),
+		rec("podcast", "b.mp3", "n1", now.Add(-2*time.Hour)),
+		rec("podcast", "c.mp3", "n1", now.Add(-30*time.Hour)),
+		rec("radio", "a.mp3", "n3", now),
+		rec("radio", "old.mp3", "n3", now.Add(-72*time.Hour)),               // out of retention
+		{Service: "radio", FileName: "a.mp3", TS: now, RefererDenied: true}, // not a download
+	})
+
+	items, err := store.Top("podcast", TopByFile, 24*time.Hour, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "a.mp3", Count: 2}, {Name: "b.mp3", Count: 1}}, items)
+
+	items, err = store.Top("podcast", TopByFile, 48*time.Hour, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "a.mp3", Count: 2}}, items, "limited")
+
+	items, err = store.Top("", TopByFile, 24*time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "a.mp3", Count: 3}, {Name: "b.mp3", Count: 1}}, items, "all services")
+
+	items, err = store.Top("podcast", TopByNode, 48*time.Hour, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "n1", Count: 3}, {Name: "n2", Count: 1}}, items)
+
+	items, err = store.Top("", TopByService, 48*time.Hour, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "podcast", Count: 4}, {Name: "radio", Count: 1}}, items)
+
+	_, err = store.Top("", "referer", time.Hour, 10)
+	assert.EqualError(t, err, `unsupported grouping "referer", allowed file, node or service`)
+	_, err = store.Top("", TopByFile, 72*time.Hour, 10)
+	assert.EqualError(t, err, "period 72h0m0s out of (0..48h0m0s] range")
+}
+
+func TestStatsStore_Timeline(t *testing.T) {
+	store, err := NewStatsStore(StoreParams{Bucket: time.Hour})
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now()
+	writeRecs(t, store, []LogRecord{
+		{Service: "podcast", FileName: "a.mp3", TS: now},
+		{Service: "podcast", FileName: "b.mp3", TS: now},
+		{Service: "podcast", FileName: "a.mp3", TS: now.Add(-2 * time.Hour)},
+		{Service: "radio", FileName: "a.mp3", TS: now},
+	})
+
+	points, err := store.Timeline("podcast", "", 3*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, points, 3)
+	assert.Equal(t, now.Truncate(time.Hour).Add(-2*time.Hour).UTC(), points[0].TS)
+	assert.Equal(t, []int{1, 0, 2}, timelineCounts(points))
+
+	points, err = store.Timeline("", "a.mp3", 3*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 0, 2}, timelineCounts(points), "a.mp3 in all services")
+
+	points, err = store.Timeline("podcast", "", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, timelineCounts(points), "current bucket only")
+
+	_, err = store.Timeline("podcast", "", 0)
+	assert.Error(t, err)
+}
+
+func TestStatsStore_TimelineSmallBucket(t *testing.T) {
+	// sub-second part of bucket cut off, 500ms bucket means default one, no zero step
+	store, err := NewStatsStore(StoreParams{Bucket: 500 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, store.bucket)
+	require.NoError(t, store.Close())
+
+	store, err = NewStatsStore(StoreParams{Bucket: 1500 * time.Millisecond, Retention: time.Minute})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, time.Second, store.bucket)
+	now := time.Now()
+	writeRecs(t, store, []LogRecord{
+		{Service: "podcast", FileName: "a.mp3", TS: now},
+		{Service: "podcast", FileName: "a.mp3", TS: now.Add(-3 * time.Second)},
+	})
+	points, err := store.Timeline("podcast", "", 10*time.Second)
+	require.NoError(t, err)
+	total := 0
+	for _, p := range points {
+		total += p.Count
+	}
+	assert.Equal(t, 2, total, "steps aligned with buckets, no counts missed")
+}
+
+func TestStatsStore_Persist(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "stats.json")
+	store, err := NewStatsStore(StoreParams{Path: fname, Bucket: time.Hour, SaveInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, "store:"+fname, store.String())
+
+	now, day := time.Now(), time.Now().Truncate(24*time.Hour)
+	writeRecs(t, store, []LogRecord{
+		{Service: "podcast", FileName: "a.mp3", DestHost: "n1", TS: day},
+		{Service: "podcast", FileName: "a.mp3", DestHost: "n1", TS: day.Add(time.Hour)},
+	})
+	assert.Eventually(t, func() bool {
+		_, e := os.Stat(fname)
+		return e == nil
+	}, time.Second, 10*time.Millisecond, "saved periodically")
+	require.NoError(t, store.Close())
+
+	// reloaded with a larger bucket, both records in the same day
+	store, err = NewStatsStore(StoreParams{Path: fname, Bucket: 24 * time.Hour})
+	require.NoError(t, err)
+	items, err := store.Top("podcast", TopByFile, 48*time.Hour, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "a.mp3", Count: 2}}, items)
+	writeRecs(t, store, []LogRecord{{Service: "podcast", FileName: "b.mp3", TS: now}})
+	require.NoError(t, store.Close())
+
+	store, err = NewStatsStore(StoreParams{Path: fname})
+	require.NoError(t, err)
+	items, err = store.Top("podcast", TopByFile, 48*time.Hour, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []TopItem{{Name: "a.mp3", Count: 2}, {Name: "b.mp3", Count: 1}}, items, "saved on close")
+	require.NoError(t, store.Close())
+
+	require.NoError(t, os.WriteFile(fname, []byte("bad json"), 0o600))
+	_, err = NewStatsStore(StoreParams{Path: fname})
+	assert.Error(t, err)
+}
+
+func TestStatsStore_RetentionInMemory(t *testing.T) {
+	store, err := NewStatsStore(StoreParams{Bucket: time.Hour, Retention: 24 * time.Hour})
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now()
+	writeRecs(t, store, []LogRecord{{Service: "podcast", FileName: "a.mp3", TS: now}})
+	store.lock.Lock()
+	stale := store.bucketStart(now.Add(-48 * time.Hour))
+	store.counts(stale, "podcast").Total++
+	store.prunedTo = 0 // as if written long ago, before the last prune
+	store.lock.Unlock()
+
+	writeRecs(t, store, []LogRecord{{Service: "podcast", FileName: "b.mp3", TS: now}})
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	assert.Len(t, store.buckets, 1, "expired bucket dropped on write with no file to save")
+	assert.NotContains(t, store.buckets, stale)
+}
+
+func TestParsePeriod(t *testing.T) {
+	tbl := []struct {
+		in   string
+		res  time.Duration
+		fail bool
+	}{
+		{in: "24h", res: 24 * time.Hour},
+		{in: "90m", res: 90 * time.Minute},
+		{in: "7d", res: 7 * 24 * time.Hour},
+		{in: "xd", fail: true},
+		{in: "abc", fail: true},
+		{in: "", fail: true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			res, err := ParsePeriod(tt.in)
+			if tt.fail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+// writeRecs writes all records to the store
+func writeRecs(t *testing.T, store *StatsStore, recs []LogRecord) {
+	n, err := store.Write(context.Background(), recs)
+	require.NoError(t, err)
+	require.Equal(t, len(recs), n)
+}
+
+func timelineCounts(points []TimelinePoint) []int {
+	res := make([]int, 0, len(points))
+	for _, p := range points {
+		res = append(res, p.Count)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/umputun/rlb/app/config"
+	"github.com/umputun/rlb/app/picker"
+	"github.com/umputun/rlb/app/sign"
+)
+
+// signParams defines signed link made by sign command
+type signParams struct {
+	svc      string
+	resource string
+	base     string // rlb url, or service's host url if host set
+	host     bool   // link to service's own host, without jump prefix
+	ttl      time.Duration
+}
+
+// runSign loads config and prints signed link to resource of the service, valid for ttl.
+// Returns exit code, non-zero if config is invalid, service not signed or resource invalid.
+func runSign(confFile string, params signParams, out io.Writer) int {
+	fh, err := os.Open(confFile) // nolint:gosec // config file name comes from cli
+	if err != nil {
+		fmt.Fprintf(out, "failed to open %s, %v\n", confFile, err)
+		return 1
+	}
+	conf, _, err := config.Load(fh)
+	_ = fh.Close()
+	if err != nil {
+		fmt.Fprintf(out, "failed to load %s, %v\n", confFile, err)
+		return 1
+	}
+
+	svc, ok := conf.Services[params.svc]
+	if !ok {
+		fmt.Fprintf(out, "no service %s in %s\n", params.svc, confFile)
+		return 1
+	}
+	if svc.Sign.Secret == "" {
+		fmt.Fprintf(out, "service %s has no sign.secret\n", params.svc)
+		return 1
+	}
+	resource, err := picker.NormalizeResource(params.resource)
+	if err != nil {
+		fmt.Fprintf(out, "%v\n", err)
+		return 1
+	}
+
+	expires := time.Now().Add(params.ttl)
+	if params.host {
+		fmt.Fprintln(out, sign.HostLink(params.base, svc.Sign.Secret, params.svc, resource, expires))
+		return 0
+	}
+	fmt.Fprintln(out, sign.Link(params.base, svc.Sign.Secret, params.svc, resource, expires))
+	return 0
+}
@@ -0,0 +1,136 @@
+// Package sign makes and verifies expiring signed jump links, and nginx secure_link tokens for nodes
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/md5" // nolint:gosec // nginx secure_link uses md5
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query params of signed link
+const (
+	ExpiresParam = "expires"
+	SigParam     = "sig"
+)
+
+// query params of nginx secure_link token added to redirect url
+const (
+	NodeTokenParam   = "md5"
+	NodeExpiresParam = "expires"
+)
+
+// errors of Verify
+var (
+	ErrNoSignature = errors.New("no signature")
+	ErrExpired     = errors.New("link expired")
+	ErrBadSig      = errors.New("bad signature")
+)
+
+// Signature returns HMAC-SHA256 of svc, resource and expiration unix time, base64 url-encoded without padding
+func Signature(secret, svc, resource string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(svc + "\n" + resource + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Query returns query params of the link to resource of svc, valid till expires
+func Query(secret, svc, resource string, expires time.Time) url.Values {
+	return url.Values{
+		ExpiresParam: []string{strconv.FormatInt(expires.Unix(), 10)},
+		SigParam:     []string{Signature(secret, svc, resource, expires.Unix())},
+	}
+}
+
+// Link makes signed link to resource of svc, valid till expires. Base is rlb url, like http://rlb.example.com,
+// and the link is in path form, i.e. http://rlb.example.com/api/v1/jump/podcast/rtfiles/x.mp3?expires=...&sig=...
+// Resource should be normalized, as the server verifies signature of the normalized one.
+func Link(base, secret, svc, resource string, expires time.Time) string {
+	return linkWithQuery(strings.TrimSuffix(base, "/")+"/api/v1/jump/"+url.PathEscape(svc)+resource,
+		Query(secret, svc, resource, expires))
+}
+
+// HostLink makes signed link to resource of svc served on its own host, i.e.
+// http://media.example.com/rtfiles/x.mp3?expires=...&sig=...
+func HostLink(base, secret, svc, resource string, expires time.Time) string {
+	return linkWithQuery(strings.TrimSuffix(base, "/")+resource, Query(secret, svc, resource, expires))
+}
+
+// Verify checks signature of resource of svc and its expiration unix time, both taken from the link's query
+func Verify(secret, svc, resource, expires, sig string, now time.Time) error {
+	if expires == "" || sig == "" {
+		return ErrNoSignature
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w, invalid expires %q", ErrBadSig, expires)
+	}
+	if now.Unix() > exp {
+		return ErrExpired
+	}
+	if !hmac.Equal([]byte(sig), []byte(Signature(secret, svc, resource, exp))) {
+		return ErrBadSig
+	}
+	return nil
+}
+
+// Strip removes params of signed link from resource's query, order of other params kept
+func Strip(resource string) string {
+	path, query, ok := strings.Cut(resource, "?")
+	if !ok {
+		return resource
+	}
+	var keep []string
+	for _, kv := range strings.Split(query, "&") {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == ExpiresParam || k == SigParam || kv == "" {
+			continue
+		}
+		keep = append(keep, kv)
+	}
+	if len(keep) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(keep, "&")
+}
+
+// NodeToken returns token of nginx secure_link module for url path, valid till expires, made as
+//
+//	secure_link_md5 "$secure_link_expires$uri <secret>";
+//
+// i.e. base64 url-encoded md5 of expires, path, space and secret, without padding
+func NodeToken(secret, path string, expires int64) string {
+	sum := md5.Sum([]byte(strconv.FormatInt(expires, 10) + path + " " + secret)) // nolint:gosec // nginx secure_link
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AddNodeToken adds nginx secure_link token and expiration to the url, verified on the node with
+//
+//	secure_link $arg_md5,$arg_expires;
+func AddNodeToken(rawURL, secret string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("can't parse %s: %w", rawURL, err)
+	}
+	token := NodeToken(secret, u.Path, expires.Unix())
+	params := NodeTokenParam + "=" + token + "&" + NodeExpiresParam + "=" + strconv.FormatInt(expires.Unix(), 10)
+	if u.RawQuery != "" {
+		u.RawQuery += "&" + params
+	} else {
+		u.RawQuery = params
+	}
+	return u.String(), nil
+}
+
+func linkWithQuery(link string, q url.Values) string {
+	if strings.Contains(link, "?") {
+		return link + "&" + q.Encode()
+	}
+	return link + "?" + q.Encode()
+}
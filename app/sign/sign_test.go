@@ -0,0 +1,86 @@
+package sign
+
+import (
+	"crypto/md5" // nolint:gosec // nginx secure_link uses md5
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLink(t *testing.T) {
+	expires := time.Unix(1700000000, 0)
+	link := Link("http://rlb.example.com/", "secret", "podcast", "/rtfiles/x.mp3", expires)
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v1/jump/podcast/rtfiles/x.mp3", u.Path)
+	assert.Equal(t, "1700000000", u.Query().Get(ExpiresParam))
+	assert.Equal(t, Signature("secret", "podcast", "/rtfiles/x.mp3", 1700000000), u.Query().Get(SigParam))
+
+	link = HostLink("https://media.example.com", "secret", "podcast", "/x.mp3?ts=1", expires)
+	u, err = url.Parse(link)
+	require.NoError(t, err)
+	assert.Equal(t, "media.example.com", u.Host)
+	assert.Equal(t, "/x.mp3", u.Path)
+	assert.Equal(t, "1", u.Query().Get("ts"))
+	assert.Equal(t, Signature("secret", "podcast", "/x.mp3?ts=1", 1700000000), u.Query().Get(SigParam))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	exp := "1700000100"
+	sig := Signature("secret", "podcast", "/x.mp3", 1700000100)
+
+	assert.NoError(t, Verify("secret", "podcast", "/x.mp3", exp, sig, now))
+	assert.NoError(t, Verify("secret", "podcast", "/x.mp3", exp, sig, now.Add(100*time.Second)), "expires inclusive")
+	assert.ErrorIs(t, Verify("secret", "podcast", "/x.mp3", exp, sig, now.Add(101*time.Second)), ErrExpired)
+	assert.ErrorIs(t, Verify("secret", "podcast", "/y.mp3", exp, sig, now), ErrBadSig, "other resource")
+	assert.ErrorIs(t, Verify("secret", "radio", "/x.mp3", exp, sig, now), ErrBadSig, "other service")
+	assert.ErrorIs(t, Verify("other", "podcast", "/x.mp3", exp, sig, now), ErrBadSig, "other secret")
+	assert.ErrorIs(t, Verify("secret", "podcast", "/x.mp3", "1700000200", sig, now), ErrBadSig, "extended expiration")
+	assert.ErrorIs(t, Verify("secret", "podcast", "/x.mp3", "bad", sig, now), ErrBadSig)
+	assert.ErrorIs(t, Verify("secret", "podcast", "/x.mp3", "", sig, now), ErrNoSignature)
+	assert.ErrorIs(t, Verify("secret", "podcast", "/x.mp3", exp, "", now), ErrNoSignature)
+}
+
+func TestStrip(t *testing.T) {
+	tbl := map[string]string{
+		"/x.mp3":                           "/x.mp3",
+		"/x.mp3?expires=1&sig=abc":         "/x.mp3",
+		"/x.mp3?b=2&expires=1&a=1&sig=abc": "/x.mp3?b=2&a=1",
+		"/x.mp3?ts=1":                      "/x.mp3?ts=1",
+		"/x.mp3?":                          "/x.mp3",
+		"/x.mp3?signature=1&expires_at=2":  "/x.mp3?signature=1&expires_at=2",
+	}
+	for in, res := range tbl {
+		assert.Equal(t, res, Strip(in), in)
+	}
+}
+
+func TestAddNodeToken(t *testing.T) {
+	expires := time.Unix(2147483647, 0)
+	// same as echo -n '2147483647/s/link secret' | openssl md5 -binary | openssl base64 | tr +/ -_ | tr -d =
+	sum := md5.Sum([]byte("2147483647/s/link secret")) // nolint:gosec // nginx secure_link
+	token := base64.RawURLEncoding.EncodeToString(sum[:])
+	assert.Equal(t, token, NodeToken("secret", "/s/link", 2147483647))
+
+	res, err := AddNodeToken("http://n1.radio-t.com/s/link", "secret", expires)
+	require.NoError(t, err)
+	assert.Equal(t, "http://n1.radio-t.com/s/link?md5="+token+"&expires=2147483647", res)
+
+	res, err = AddNodeToken("http://n1.radio-t.com/s/link?ts=1", "secret", expires)
+	require.NoError(t, err)
+	assert.Equal(t, "http://n1.radio-t.com/s/link?ts=1&md5="+token+"&expires=2147483647", res)
+
+	res, err = AddNodeToken("http://n1.radio-t.com/s/rt%20x.mp3", "secret", expires)
+	require.NoError(t, err)
+	u, err := url.Parse(res)
+	require.NoError(t, err)
+	assert.Equal(t, NodeToken("secret", "/s/rt x.mp3", 2147483647), u.Query().Get(NodeTokenParam), "decoded path, like nginx $uri")
+
+	_, err = AddNodeToken("http://n1.radio-t.com/%zz", "secret", expires)
+	assert.Error(t, err)
+}
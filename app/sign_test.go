@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/rlb/app/sign"
+)
+
+func TestRunSign(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "rlb.yml")
+	conf := "services:\n" +
+		" podcast:\n  sign:\n   secret: secret1234567890\n  nodes:\n   - server: http://n1.radio-t.com\n     weight: 1\n" +
+		" radio:\n  - server: http://n2.radio-t.com\n    weight: 1\n"
+	require.NoError(t, os.WriteFile(fname, []byte(conf), 0o600))
+
+	t.Run("jump link", func(t *testing.T) {
+		out := bytes.Buffer{}
+		code := runSign(fname, signParams{svc: "podcast", resource: "/rtfiles/../rt%20x.mp3", base: "http://rlb.example.com",
+			ttl: time.Hour}, &out)
+		require.Equal(t, 0, code, out.String())
+		u, err := url.Parse(strings.TrimSpace(out.String()))
+		require.NoError(t, err)
+		assert.Equal(t, "rlb.example.com", u.Host)
+		assert.Equal(t, "/api/v1/jump/podcast/rt%20x.mp3", u.EscapedPath())
+		exp, err := strconv.ParseInt(u.Query().Get(sign.ExpiresParam), 10, 64)
+		require.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), exp, 5)
+		assert.Equal(t, sign.Signature("secret1234567890", "podcast", "/rt%20x.mp3", exp), u.Query().Get(sign.SigParam),
+			"normalized resource signed")
+	})
+
+	t.Run("host link", func(t *testing.T) {
+		out := bytes.Buffer{}
+		code := runSign(fname, signParams{svc: "podcast", resource: "/x.mp3?ts=1", base: "https://media.example.com",
+			host: true, ttl: time.Hour}, &out)
+		require.Equal(t, 0, code, out.String())
+		assert.True(t, strings.HasPrefix(out.String(), "https://media.example.com/x.mp3?ts=1&expires="), out.String())
+	})
+
+	tbl := []struct {
+		name, file, svc, resource, err string
+	}{
+		{"no config", "/no/such/file.yml", "podcast", "/x.mp3", "failed to open /no/such/file.yml"},
+		{"unknown service", fname, "bad", "/x.mp3", "no service bad in " + fname},
+		{"not signed", fname, "radio", "/x.mp3", "service radio has no sign.secret"},
+		{"bad resource", fname, "podcast", "//evil.com/x.mp3", "bad resource"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			out := bytes.Buffer{}
+			code := runSign(tt.file, signParams{svc: tt.svc, resource: tt.resource, base: "http://localhost", ttl: time.Hour}, &out)
+			assert.Equal(t, 1, code)
+			assert.Contains(t, out.String(), tt.err)
+		})
+	}
+}